@@ -0,0 +1,55 @@
+package diff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	a := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n"
+	b := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\n"
+	got := Unified("old", "new", a, b, 1)
+	want := `--- old
++++ new
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+ c
+@@ -10 +10,2 @@
+ j
++k
+`
+	if got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnifiedMergesCloseHunks(t *testing.T) {
+	got := Unified("a", "b", "1\n2\n3\n4\n5\n", "1\nX\n3\nY\n5\n", 1)
+	want := `--- a
++++ b
+@@ -1,5 +1,5 @@
+ 1
+-2
++X
+ 3
+-4
++Y
+ 5
+`
+	if got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnifiedEmptySides(t *testing.T) {
+	if got := Unified("a", "b", "same\n", "same\n", 3); got != "" {
+		t.Fatalf("expected no diff, got %q", got)
+	}
+	want := "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+x\n+y\n"
+	if got := Unified("a", "b", "", "x\ny\n", 3); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	want = "--- a\n+++ b\n@@ -1 +0,0 @@\n-x\n"
+	if got := Unified("a", "b", "x\n", "", 3); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+// stringList is a flag.Value that collects repeated and comma separated values,
+// e.g. --host github.com --host gitlab.com or --host github.com,gitlab.com.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			*l = append(*l, part)
+		}
+	}
+	return nil
+}
+
+// optionList is a flag.Value that collects repeated ssh options given as Key=Value,
+// e.g. --ssh-option Port=2222 --ssh-option ProxyJump=bastion. Values may contain commas.
+type optionList []sshconfig.Option
+
+func (l *optionList) String() string {
+	if l == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(*l))
+	for _, o := range *l {
+		parts = append(parts, o.Key+"="+o.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l *optionList) Set(v string) error {
+	o, err := sshconfig.ParseOption(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, o)
+	return nil
+}
@@ -0,0 +1,103 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteFileKeepsModeAndSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits and symlinks differ on windows")
+	}
+	d := t.TempDir()
+	real := filepath.Join(d, "dotfiles", "ssh_config")
+	os.MkdirAll(filepath.Dir(real), 0o700)
+	if err := os.WriteFile(real, []byte("old"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(d, "config")
+	if err := os.Symlink(real, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := WriteFile(link, []byte("new"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("symlink was replaced by a regular file")
+	}
+	b, _ := os.ReadFile(real)
+	if string(b) != "new" {
+		t.Fatalf("target not updated: %s", b)
+	}
+	info, _ = os.Stat(real)
+	if info.Mode().Perm() != 0o640 {
+		t.Fatalf("mode not preserved: %v", info.Mode().Perm())
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(real), ".*tmp*")); len(leftovers) != 0 {
+		t.Fatalf("temporary files left behind: %v", leftovers)
+	}
+}
+
+func TestWriteFileNewFile(t *testing.T) {
+	d := t.TempDir()
+	p := filepath.Join(d, "keys.json")
+	if err := WriteFile(p, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil || string(b) != "{}" {
+		t.Fatalf("unexpected content %q: %v", b, err)
+	}
+	if runtime.GOOS != "windows" {
+		if info, _ := os.Stat(p); info.Mode().Perm() != 0o600 {
+			t.Fatalf("unexpected mode: %v", info.Mode().Perm())
+		}
+	}
+}
+
+func TestAcquireSerializes(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config")
+	l, err := Acquire(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	acquired := false
+	done := make(chan struct{})
+	go func() {
+		l2, err := Acquire(p)
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		mu.Lock()
+		acquired = true
+		mu.Unlock()
+		l2.Unlock()
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	early := acquired
+	mu.Unlock()
+	if early {
+		t.Fatal("second Acquire did not wait for the first lock")
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
@@ -0,0 +1,42 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Lock is an advisory inter-process lock guarding a file. It is held on a sibling
+// "<file>.lock" file because the guarded file itself is replaced on every write.
+type Lock struct {
+	f *os.File
+}
+
+// Acquire blocks until the lock guarding path is held. Symlinks at path are resolved
+// so every name of the same file shares one lock.
+func Acquire(path string) (*Lock, error) {
+	target, err := resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(target+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Unlock releases the lock. The lock file is left in place for the next user.
+func (l *Lock) Unlock() error {
+	if err := unlockFile(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package fsutil
+
+import "os"
+
+// Platforms without flock or LockFileEx get no inter-process locking; writes are still atomic.
+
+func lockFile(f *os.File) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
@@ -4,7 +4,6 @@ go 1.25.5
 
 require (
 	golang.org/x/crypto v0.46.0
+	golang.org/x/sys v0.39.0
 	golang.org/x/term v0.38.0
 )
-
-require golang.org/x/sys v0.39.0 // indirect
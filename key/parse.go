@@ -0,0 +1,87 @@
+package key
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParsePrivateKey parses a private key in any format understood by golang.org/x/crypto/ssh
+// (PKCS#1, SEC1, PKCS#8 or OpenSSH) and returns its public key.
+// If the key is encrypted and passphrase is nil, the error is an *ssh.PassphraseMissingError.
+func ParsePrivateKey(data, passphrase []byte) (ssh.PublicKey, error) {
+	var raw interface{}
+	var err error
+	if passphrase == nil {
+		raw, err = ssh.ParseRawPrivateKey(data)
+	} else {
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return signer.PublicKey(), nil
+}
+
+// ConvertPrivateKey re-encodes a private key according to opts without changing the key itself.
+// opts.Passphrase is used both to decrypt data and to encrypt the result.
+func ConvertPrivateKey(data []byte, comment string, opts Options) ([]byte, error) {
+	var raw interface{}
+	var err error
+	if opts.Passphrase == nil {
+		raw, err = ssh.ParseRawPrivateKey(data)
+	} else {
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(data, opts.Passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return EncodePrivateKey(raw, comment, opts)
+}
+
+// Format reports the encoding of a PEM encoded private key: FormatOpenSSH or FormatPEM.
+func Format(data []byte) (string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return "", errors.New("no PEM data found")
+	}
+	if block.Type == "OPENSSH PRIVATE KEY" {
+		return FormatOpenSSH, nil
+	}
+	return FormatPEM, nil
+}
+
+// Algorithm returns the algorithm name of pub. Keys matching one of the generators
+// use its constant (e.g. "ed25519", "p256"); other RSA sizes are reported as "rsa<bits>".
+func Algorithm(pub ssh.PublicKey) (string, error) {
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return "", fmt.Errorf("unsupported key type: %s", pub.Type())
+	}
+	switch k := cpk.CryptoPublicKey().(type) {
+	case ed25519.PublicKey:
+		return ED25519, nil
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", k.N.BitLen()), nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return P256, nil
+		case elliptic.P384():
+			return P384, nil
+		case elliptic.P521():
+			return P521, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type: %s", pub.Type())
+}
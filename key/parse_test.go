@@ -0,0 +1,68 @@
+package key
+
+import (
+	"testing"
+)
+
+func TestParsePrivateKeyAlgorithm(t *testing.T) {
+	for _, alg := range []string{RSA2048, P256, P384, P521, ED25519} {
+		t.Run(alg, func(t *testing.T) {
+			priv, _, err := generators[alg].Generate("alice", "example.com", Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub, err := ParsePrivateKey([]byte(priv), nil)
+			if err != nil {
+				t.Fatalf("parse error for %s: %v", alg, err)
+			}
+			got, err := Algorithm(pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != alg {
+				t.Fatalf("expected %s, got %s", alg, got)
+			}
+		})
+	}
+}
+
+func TestConvertPrivateKey(t *testing.T) {
+	for _, alg := range []string{RSA2048, P256, P521, ED25519} {
+		t.Run(alg, func(t *testing.T) {
+			priv, _, err := generators[alg].Generate("alice", "example.com", Options{Format: FormatPEM})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f, _ := Format([]byte(priv)); f != FormatPEM {
+				t.Fatalf("expected pem, got %s", f)
+			}
+			before, err := ParsePrivateKey([]byte(priv), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			converted, err := ConvertPrivateKey([]byte(priv), "alice@example.com", Options{Format: FormatOpenSSH})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f, _ := Format(converted); f != FormatOpenSSH {
+				t.Fatalf("expected openssh, got %s", f)
+			}
+			after, err := ParsePrivateKey(converted, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(before.Marshal()) != string(after.Marshal()) {
+				t.Fatalf("public key changed by conversion")
+			}
+
+			back, err := ConvertPrivateKey(converted, "", Options{Format: FormatPEM})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f, _ := Format(back); f != FormatPEM {
+				t.Fatalf("expected pem, got %s", f)
+			}
+		})
+	}
+}
@@ -23,51 +23,67 @@ const (
 	ED25519 = "ed25519"
 )
 
+// Private key formats
+const (
+	// FormatOpenSSH is the "OPENSSH PRIVATE KEY" container written by ssh-keygen.
+	FormatOpenSSH = "openssh"
+	// FormatPEM is the legacy encoding: PKCS#1 for RSA, SEC1 for ECDSA and PKCS#8 for Ed25519.
+	FormatPEM = "pem"
+)
+
+// Options control how a generated private key is encoded.
+type Options struct {
+	// Format is FormatOpenSSH (the default when empty) or FormatPEM.
+	Format string
+	// Passphrase, if non-nil, encrypts the private key. Encrypted keys require FormatOpenSSH.
+	Passphrase []byte
+}
+
 // KeyGenerator interface
 type KeyGenerator interface {
-	Generate(name, email string) (privateKey, publicKey string, err error)
+	Generate(name, email string, opts Options) (privateKey, publicKey string, err error)
 }
 
 // RSA2048Generator implements KeyGenerator for RSA 2048-bit
 type RSA2048Generator struct{}
 
-func (g *RSA2048Generator) Generate(name, email string) (string, string, error) {
-	return generateRSA(2048, name, email)
+func (g *RSA2048Generator) Generate(name, email string, opts Options) (string, string, error) {
+	return generateRSA(2048, name, email, opts)
 }
 
 // RSA4096Generator implements KeyGenerator for RSA 4096-bit
 type RSA4096Generator struct{}
 
-func (g *RSA4096Generator) Generate(name, email string) (string, string, error) {
-	return generateRSA(4096, name, email)
+func (g *RSA4096Generator) Generate(name, email string, opts Options) (string, string, error) {
+	return generateRSA(4096, name, email, opts)
 }
 
 // P256Generator implements KeyGenerator for ECDSA P-256
 type P256Generator struct{}
 
-func (g *P256Generator) Generate(name, email string) (string, string, error) {
-	return generateECDSA(elliptic.P256(), name, email)
+func (g *P256Generator) Generate(name, email string, opts Options) (string, string, error) {
+	return generateECDSA(elliptic.P256(), name, email, opts)
 }
 
 // P384Generator implements KeyGenerator for ECDSA P-384
 type P384Generator struct{}
 
-func (g *P384Generator) Generate(name, email string) (string, string, error) {
-	return generateECDSA(elliptic.P384(), name, email)
+func (g *P384Generator) Generate(name, email string, opts Options) (string, string, error) {
+	return generateECDSA(elliptic.P384(), name, email, opts)
 }
 
 // P521Generator implements KeyGenerator for ECDSA P-521
 type P521Generator struct{}
 
-func (g *P521Generator) Generate(name, email string) (string, string, error) {
-	return generateECDSA(elliptic.P521(), name, email)
+func (g *P521Generator) Generate(name, email string, opts Options) (string, string, error) {
+	return generateECDSA(elliptic.P521(), name, email, opts)
 }
 
 // ED25519Generator implements KeyGenerator for Ed25519
 type ED25519Generator struct{}
 
-func (g *ED25519Generator) Generate(name, email string) (string, string, error) {
-	return generateEd25519(name, email)
+func (g *ED25519Generator) Generate(name, email string, opts Options) (string, string, error) {
+	return generateEd25519(name, email, opts)
 }
 
 // Global map of generators
@@ -89,111 +105,124 @@ func GetKeyGenerator(algo string) (KeyGenerator, error) {
 	return gen, nil
 }
 
-// Helper functions
-
-func generateRSA(bits int, name, email string) (string, string, error) {
-	privKey, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return "", "", err
-	}
-
-	der := x509.MarshalPKCS1PrivateKey(privKey)
-	privKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: der,
-	})
-
-	pubKey, err := ssh.NewPublicKey(&privKey.PublicKey)
-	if err != nil {
-		return "", "", err
+// EncodePrivateKey encodes privKey (*rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey)
+// according to opts. comment is embedded in OpenSSH keys and ignored for PEM.
+func EncodePrivateKey(privKey interface{}, comment string, opts Options) ([]byte, error) {
+	// ssh.ParseRawPrivateKey returns a pointer for OpenSSH Ed25519 keys
+	if k, ok := privKey.(*ed25519.PrivateKey); ok {
+		privKey = *k
 	}
 
-	pubKeyString := string(ssh.MarshalAuthorizedKey(pubKey))
-	// ssh.MarshalAuthorizedKey ends with newline, trim it to append comment
-	if len(pubKeyString) > 0 && pubKeyString[len(pubKeyString)-1] == '\n' {
-		pubKeyString = pubKeyString[:len(pubKeyString)-1]
+	switch opts.Format {
+	case "", FormatOpenSSH:
+		var block *pem.Block
+		var err error
+		if opts.Passphrase != nil {
+			block, err = ssh.MarshalPrivateKeyWithPassphrase(privKey, comment, opts.Passphrase)
+		} else {
+			block, err = ssh.MarshalPrivateKey(privKey, comment)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(block), nil
+	case FormatPEM:
+		if opts.Passphrase != nil {
+			return nil, fmt.Errorf("passphrase protected keys require the %s format", FormatOpenSSH)
+		}
+		return legacyPEM(privKey)
 	}
-	pubKeyString += fmt.Sprintf(" %s@%s", name, email)
-
-	return string(privKeyPEM), pubKeyString, nil
+	return nil, fmt.Errorf("unsupported key format: %s", opts.Format)
 }
 
-func generateECDSA(curve elliptic.Curve, name, email string) (string, string, error) {
-	privKey, err := ecdsa.GenerateKey(curve, rand.Reader)
-	if err != nil {
-		return "", "", err
-	}
+// Helper functions
 
-	der, err := x509.MarshalECPrivateKey(privKey)
-	if err != nil {
-		// Fallback to PKCS#8 if MarshalECPrivateKey is not supported for the curve
-		der, err = x509.MarshalPKCS8PrivateKey(privKey)
+// legacyPEM encodes privKey in the format used before OpenSSH became the default.
+func legacyPEM(privKey interface{}) ([]byte, error) {
+	switch k := privKey.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(k),
+		}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
 		if err != nil {
-			return "", "", err
+			// Fallback to PKCS#8 if MarshalECPrivateKey is not supported for the curve
+			der, err = x509.MarshalPKCS8PrivateKey(k)
+			if err != nil {
+				return nil, err
+			}
+			return pem.EncodeToMemory(&pem.Block{
+				Type:  "PRIVATE KEY",
+				Bytes: der,
+			}), nil
 		}
-		privKeyPEM := pem.EncodeToMemory(&pem.Block{
-			Type:  "PRIVATE KEY",
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
 			Bytes: der,
-		})
-
-		pubKey, err := ssh.NewPublicKey(&privKey.PublicKey)
+		}), nil
+	case ed25519.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
 		if err != nil {
-			return "", "", err
+			return nil, err
 		}
-
-		pubKeyString := string(ssh.MarshalAuthorizedKey(pubKey))
-		if len(pubKeyString) > 0 && pubKeyString[len(pubKeyString)-1] == '\n' {
-			pubKeyString = pubKeyString[:len(pubKeyString)-1]
-		}
-		pubKeyString += fmt.Sprintf(" %s@%s", name, email)
-		return string(privKeyPEM), pubKeyString, nil
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: der,
+		}), nil
 	}
+	return nil, fmt.Errorf("unsupported private key type %T", privKey)
+}
 
-	privKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: der,
-	})
-
-	pubKey, err := ssh.NewPublicKey(&privKey.PublicKey)
+// authorizedKey returns the authorized_keys line for pub with a "name@email" comment.
+func authorizedKey(pub interface{}, name, email string) (string, error) {
+	sshPubKey, err := ssh.NewPublicKey(pub)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
-
-	pubKeyString := string(ssh.MarshalAuthorizedKey(pubKey))
+	pubKeyString := string(ssh.MarshalAuthorizedKey(sshPubKey))
+	// ssh.MarshalAuthorizedKey ends with newline, trim it to append comment
 	if len(pubKeyString) > 0 && pubKeyString[len(pubKeyString)-1] == '\n' {
 		pubKeyString = pubKeyString[:len(pubKeyString)-1]
 	}
 	pubKeyString += fmt.Sprintf(" %s@%s", name, email)
-
-	return string(privKeyPEM), pubKeyString, nil
+	return pubKeyString, nil
 }
 
-func generateEd25519(name, email string) (string, string, error) {
-	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+// encodeKeyPair encodes a freshly generated key pair.
+func encodeKeyPair(privKey, pubKey interface{}, name, email string, opts Options) (string, string, error) {
+	privKeyPEM, err := EncodePrivateKey(privKey, fmt.Sprintf("%s@%s", name, email), opts)
 	if err != nil {
 		return "", "", err
 	}
-
-	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	pubKeyString, err := authorizedKey(pubKey, name, email)
 	if err != nil {
 		return "", "", err
 	}
+	return string(privKeyPEM), pubKeyString, nil
+}
 
-	privKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: der,
-	})
-
-	sshPubKey, err := ssh.NewPublicKey(pubKey)
+func generateRSA(bits int, name, email string, opts Options) (string, string, error) {
+	privKey, err := rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return "", "", err
 	}
+	return encodeKeyPair(privKey, &privKey.PublicKey, name, email, opts)
+}
 
-	pubKeyString := string(ssh.MarshalAuthorizedKey(sshPubKey))
-	if len(pubKeyString) > 0 && pubKeyString[len(pubKeyString)-1] == '\n' {
-		pubKeyString = pubKeyString[:len(pubKeyString)-1]
+func generateECDSA(curve elliptic.Curve, name, email string, opts Options) (string, string, error) {
+	privKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return "", "", err
 	}
-	pubKeyString += fmt.Sprintf(" %s@%s", name, email)
+	return encodeKeyPair(privKey, &privKey.PublicKey, name, email, opts)
+}
 
-	return string(privKeyPEM), pubKeyString, nil
+func generateEd25519(name, email string, opts Options) (string, string, error) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return encodeKeyPair(privKey, pubKey, name, email, opts)
 }
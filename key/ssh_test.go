@@ -22,12 +22,12 @@ func TestGenerators(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.alg, func(t *testing.T) {
-			priv, pub, err := tt.gen.Generate("alice", "example.com")
+			priv, pub, err := tt.gen.Generate("alice", "example.com", Options{})
 			if err != nil {
 				t.Fatalf("Generate error for %s: %v", tt.alg, err)
 			}
-			if !strings.Contains(priv, "PRIVATE KEY") {
-				t.Fatalf("private key does not contain 'PRIVATE KEY' for %s: %s", tt.alg, priv)
+			if !strings.Contains(priv, "OPENSSH PRIVATE KEY") {
+				t.Fatalf("private key is not in OpenSSH format for %s: %s", tt.alg, priv)
 			}
 			if !strings.Contains(pub, "alice@example.com") {
 				t.Fatalf("pub key does not contain identity for %s: %s", tt.alg, pub)
@@ -38,3 +38,47 @@ func TestGenerators(t *testing.T) {
 		})
 	}
 }
+
+func TestGeneratorsWithPassphrase(t *testing.T) {
+	for _, alg := range []string{RSA2048, P256, P384, P521, ED25519} {
+		t.Run(alg, func(t *testing.T) {
+			priv, _, err := generators[alg].Generate("alice", "example.com", Options{Passphrase: []byte("secret")})
+			if err != nil {
+				t.Fatalf("Generate error for %s: %v", alg, err)
+			}
+			if !strings.Contains(priv, "OPENSSH PRIVATE KEY") {
+				t.Fatalf("expected OpenSSH private key for %s: %s", alg, priv)
+			}
+			if _, err := ssh.ParseRawPrivateKey([]byte(priv)); err == nil {
+				t.Fatalf("expected %s key to be encrypted", alg)
+			}
+			if _, err := ssh.ParseRawPrivateKeyWithPassphrase([]byte(priv), []byte("secret")); err != nil {
+				t.Fatalf("failed to decrypt %s key: %v", alg, err)
+			}
+		})
+	}
+}
+
+func TestGeneratorsLegacyPEM(t *testing.T) {
+	want := map[string]string{
+		RSA2048: "RSA PRIVATE KEY",
+		P256:    "EC PRIVATE KEY",
+		ED25519: "PRIVATE KEY",
+	}
+	for alg, typ := range want {
+		priv, _, err := generators[alg].Generate("alice", "example.com", Options{Format: FormatPEM})
+		if err != nil {
+			t.Fatalf("Generate error for %s: %v", alg, err)
+		}
+		if !strings.HasPrefix(priv, "-----BEGIN "+typ+"-----") {
+			t.Fatalf("expected %s block for %s: %s", typ, alg, priv)
+		}
+		if _, err := ssh.ParseRawPrivateKey([]byte(priv)); err != nil {
+			t.Fatalf("invalid private key for %s: %v", alg, err)
+		}
+	}
+
+	if _, _, err := generators[ED25519].Generate("alice", "example.com", Options{Format: FormatPEM, Passphrase: []byte("x")}); err == nil {
+		t.Fatal("expected error for encrypted pem key")
+	}
+}
@@ -7,10 +7,16 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/snowmerak/gipo/backup"
+	"github.com/snowmerak/gipo/fsutil"
 	"github.com/snowmerak/gipo/key"
+	"golang.org/x/term"
 )
 
 const envDir = "GITPROFILES_DIR"
@@ -39,9 +45,14 @@ func Init(baseDir string) error {
 	}
 
 	// ensure keys.json exists
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 	keysMeta := filepath.Join(baseDir, "meta", "keys.json")
 	if _, err := os.Stat(keysMeta); os.IsNotExist(err) {
-		if err := os.WriteFile(keysMeta, []byte("{}"), 0o600); err != nil {
+		if err := SaveProfiles(baseDir, map[string]*Profile{}); err != nil {
 			return err
 		}
 	}
@@ -49,8 +60,10 @@ func Init(baseDir string) error {
 	return nil
 }
 
-// Add generates a key using given algo and stores it under baseDir
-func Add(baseDir, algo, name, email, host string) (privatePath, publicPath string, err error) {
+// Add generates a key using given algo and stores it under baseDir.
+// p describes the new profile; Name and Email are required, key paths and
+// the creation time are filled in by Add. opts selects the private key format and passphrase.
+func Add(baseDir, algo string, p Profile, opts key.Options) (privatePath, publicPath string, err error) {
 	if baseDir == "" {
 		home, err := os.UserHomeDir()
 		if err != nil {
@@ -59,76 +72,78 @@ func Add(baseDir, algo, name, email, host string) (privatePath, publicPath strin
 		baseDir = filepath.Join(home, ".ssh", "git_profiles")
 	}
 
+	name, email := p.Name, p.Email
 	if algo == "" || name == "" || email == "" {
 		return "", "", errors.New("algo, name and email are required")
 	}
+	if p.AliasTemplate != "" {
+		if err := validateAliasTemplate(p.AliasTemplate); err != nil {
+			return "", "", err
+		}
+	}
 
 	gen, err := key.GetKeyGenerator(algo)
 	if err != nil {
 		return "", "", err
 	}
 
-	priv, pub, err := gen.Generate(name, email)
+	priv, pub, err := gen.Generate(name, email, opts)
 	if err != nil {
 		return "", "", err
 	}
 
-	keysDir := filepath.Join(baseDir, "keys")
-	if err := os.MkdirAll(keysDir, 0o700); err != nil {
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
 		return "", "", err
 	}
+	defer lock.Unlock()
 
-	baseName := fmt.Sprintf("%s_id_%s", name, strings.ReplaceAll(algo, "-", "_"))
-	privatePath = filepath.Join(keysDir, baseName)
-	publicPath = privatePath + ".pub"
-
-	if err := os.WriteFile(privatePath, []byte(priv), 0o600); err != nil {
-		return "", "", err
-	}
-	if err := os.WriteFile(publicPath, []byte(pub), 0o644); err != nil {
+	privatePath, publicPath = keyFilePaths(baseDir, name, algo)
+	if err := writeKeyPair(privatePath, publicPath, priv, pub); err != nil {
 		return "", "", err
 	}
 
 	// update meta
 	meta, err := LoadProfiles(baseDir)
 	if err != nil {
-		// if load fails, maybe it doesn't exist or is corrupted, try to start empty if not exist
-		// but Init() ensures it exists with {}. LoadProfiles returns error if parse fails.
-		// If it's just keys.json missing despite Init, we can create new map.
-		meta = make(map[string]map[string]string)
+		// Init() ensures keys.json exists, but if it is missing we start with an empty set.
+		// A corrupted file is reported instead of being silently overwritten.
+		if !os.IsNotExist(err) {
+			return privatePath, publicPath, err
+		}
+		meta = make(map[string]*Profile)
 	}
 
-	// We want to store RELATIVE paths or just filename to be cleaner in JSON,
-	// but currently LoadProfiles reconstructs ABSOLUTE paths for usage.
-	// For storage, we can store relative path "keys/filename".
+	p.Algo = algo
+	p.Private = privatePath
+	p.Public = publicPath
+	p.Encrypted = opts.Passphrase != nil
+	p.Created = time.Now().UTC()
+	meta[name] = &p
 
-	// Re-calculate relative paths for storage
-	relPrivate := filepath.Join("keys", filepath.Base(privatePath))
-	// On Windows Join uses backslash. To be cross-platform friendly in JSON, we can convert to slashes.
-	relPrivate = filepath.ToSlash(relPrivate)
+	if err := SaveProfiles(baseDir, meta); err != nil {
+		return privatePath, publicPath, err
+	}
 
-	relPublic := filepath.Join("keys", filepath.Base(publicPath))
-	relPublic = filepath.ToSlash(relPublic)
+	return privatePath, publicPath, nil
+}
 
-	meta[name] = map[string]string{
-		"algo":    algo,
-		"private": relPrivate,
-		"public":  relPublic,
-		"email":   email,
-		"host":    host,
-	}
+// keyFilePaths returns where the key pair of profile name generated with algo is stored.
+func keyFilePaths(baseDir, name, algo string) (privatePath, publicPath string) {
+	baseName := fmt.Sprintf("%s_id_%s", name, strings.ReplaceAll(algo, "-", "_"))
+	privatePath = filepath.Join(baseDir, "keys", baseName)
+	return privatePath, privatePath + ".pub"
+}
 
-	out, err := json.MarshalIndent(meta, "", "  ")
-	if err != nil {
-		return privatePath, publicPath, err
+// writeKeyPair writes a generated key pair, creating the keys directory if needed.
+func writeKeyPair(privatePath, publicPath, priv, pub string) error {
+	if err := os.MkdirAll(filepath.Dir(privatePath), 0o700); err != nil {
+		return err
 	}
-	// metaPath needs to be reconstructed since we removed it from scope
-	metaPath := filepath.Join(baseDir, "meta", "keys.json")
-	if err := os.WriteFile(metaPath, out, 0o600); err != nil {
-		return privatePath, publicPath, err
+	if err := fsutil.WriteFile(privatePath, []byte(priv), 0o600); err != nil {
+		return err
 	}
-
-	return privatePath, publicPath, nil
+	return fsutil.WriteFile(publicPath, []byte(pub), 0o644)
 }
 
 func main() {
@@ -161,7 +176,16 @@ func main() {
 		algo := addCmd.String("algo", "ed25519", "algorithm (ed25519, rsa2048, rsa4096, p256, p384, p521)")
 		name := addCmd.String("name", "", "profile name (required)")
 		email := addCmd.String("email", "", "email/identity (required)")
-		host := addCmd.String("host", "", "host to use in ssh config (e.g. github.com)")
+		var hosts stringList
+		addCmd.Var(&hosts, "host", "host to use in ssh config (e.g. github.com); repeat or comma separate for several hosts")
+		author := addCmd.String("author", "", "git author name (user.name) for commits; defaults to the profile name")
+		display := addCmd.String("display-name", "", "human friendly label shown by list")
+		usePass := addCmd.Bool("passphrase", false, "encrypt the private key with a passphrase (prompted)")
+		passFD := addCmd.Int("passphrase-fd", -1, "read the passphrase from this file descriptor instead of prompting (implies --passphrase)")
+		format := addCmd.String("key-format", key.FormatOpenSSH, "private key format (openssh, pem)")
+		var sshOpts optionList
+		addCmd.Var(&sshOpts, "ssh-option", "extra ssh option for the profile's ssh config blocks as Key=Value (e.g. Port=2222); repeatable")
+		aliasTmpl := addCmd.String("alias-template", "", "ssh alias template for this profile, overriding the alias.template setting (e.g. {profile}.{host_short})")
 		base := addCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
 		addCmd.Parse(os.Args[2:])
 		if *name == "" || *email == "" {
@@ -169,12 +193,73 @@ func main() {
 			addCmd.Usage()
 			os.Exit(2)
 		}
-		priv, pub, err := Add(*base, *algo, *name, *email, *host)
+		var passBytes []byte
+		if *usePass || *passFD >= 0 {
+			p, err := readNewPassphrase(*passFD)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "passphrase error:", err)
+				os.Exit(1)
+			}
+			passBytes = p
+		}
+		priv, pub, err := Add(*base, *algo, Profile{
+			Name:          *name,
+			Email:         *email,
+			Hosts:         hosts,
+			AuthorName:    *author,
+			DisplayName:   *display,
+			SSHOptions:    sshOpts,
+			AliasTemplate: *aliasTmpl,
+		}, key.Options{Format: *format, Passphrase: passBytes})
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "add error:", err)
 			os.Exit(1)
 		}
 		fmt.Printf("private: %s\npublic: %s\n", priv, pub)
+	case "import", "im":
+		impCmd := flag.NewFlagSet("import", flag.ExitOnError)
+		impCmd.Usage = func() {
+			fmt.Fprintf(impCmd.Output(), "Usage: gitprofiles import [flags]\n\nCreate a profile from an existing SSH private key.\n\nFlags:\n")
+			impCmd.PrintDefaults()
+		}
+		name := impCmd.String("name", "", "profile name (required)")
+		email := impCmd.String("email", "", "email/identity (required)")
+		var hosts stringList
+		impCmd.Var(&hosts, "host", "host to use in ssh config (e.g. github.com); repeat or comma separate for several hosts")
+		author := impCmd.String("author", "", "git author name (user.name) for commits; defaults to the profile name")
+		display := impCmd.String("display-name", "", "human friendly label shown by list")
+		private := impCmd.String("private", "", "path to the existing private key (required)")
+		reference := impCmd.Bool("reference", false, "use the key in place instead of copying it into the base directory")
+		var sshOpts optionList
+		impCmd.Var(&sshOpts, "ssh-option", "extra ssh option for the profile's ssh config blocks as Key=Value (e.g. Port=2222); repeatable")
+		aliasTmpl := impCmd.String("alias-template", "", "ssh alias template for this profile, overriding the alias.template setting (e.g. {profile}.{host_short})")
+		base := impCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		impCmd.Parse(os.Args[2:])
+		if *name == "" || *email == "" || *private == "" {
+			fmt.Fprintln(os.Stderr, "error: name, email and private are required")
+			impCmd.Usage()
+			os.Exit(2)
+		}
+		askPassphrase := func() ([]byte, error) {
+			fmt.Fprint(os.Stderr, "Key passphrase: ")
+			p, err := readPassword()
+			fmt.Fprintln(os.Stderr)
+			return p, err
+		}
+		priv, pub, err := Import(*base, *private, Profile{
+			Name:          *name,
+			Email:         *email,
+			Hosts:         hosts,
+			AuthorName:    *author,
+			DisplayName:   *display,
+			SSHOptions:    sshOpts,
+			AliasTemplate: *aliasTmpl,
+		}, *reference, askPassphrase)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "import error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("private: %s\npublic: %s\n", priv, pub)
 	case "list", "l":
 		listCmd := flag.NewFlagSet("list", flag.ExitOnError)
 		listCmd.Usage = func() {
@@ -190,57 +275,247 @@ func main() {
 	case "status", "t":
 		statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
 		statusCmd.Usage = func() {
-			fmt.Fprintf(statusCmd.Output(), "Usage: gitprofiles status [flags]\n\nPreview changes to SSH config.\n\nFlags:\n")
+			fmt.Fprintf(statusCmd.Output(), "Usage: gitprofiles status [flags]\n\nPreview changes to SSH config and to the git config of directory identities.\n\nExit status is 0, or %d with --check when sync has changes to make, and 1 on errors.\n\nFlags:\n", exitPending)
 			statusCmd.PrintDefaults()
 		}
-		defaultConfig := ""
+		defaultConfig, defaultGitConfig := "", ""
 		if home, err := os.UserHomeDir(); err == nil {
 			defaultConfig = filepath.Join(home, ".ssh", "config")
+			defaultGitConfig = filepath.Join(home, ".gitconfig")
 		}
 		cfgPath := statusCmd.String("config", defaultConfig, "ssh config file path")
 		base := statusCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
 		prune := statusCmd.Bool("prune", true, "show entries that would be removed if prune is enabled")
+		showDiff := statusCmd.Bool("diff", false, "also show a unified diff of the files sync would write")
+		asJSON := statusCmd.Bool("json", false, "print the planned changes as JSON")
+		check := statusCmd.Bool("check", false, fmt.Sprintf("exit with status %d if sync has changes to make", exitPending))
+		gitCfgPath := statusCmd.String("gitconfig", defaultGitConfig, "global git config file path")
 		statusCmd.Parse(os.Args[2:])
-		adds, removes, err := PreviewSSHConfig(*base, *cfgPath, *prune)
+		ssh, err := PlanSSHConfig(*base, *cfgPath, *prune)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "status error:", err)
 			os.Exit(1)
 		}
-		if len(adds) == 0 && len(removes) == 0 {
-			fmt.Println("ssh-config is up to date")
-			return
+		plan, err := PreviewInclude(*base, *cfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "status error:", err)
+			os.Exit(1)
 		}
-		if len(adds) > 0 {
-			fmt.Println("Entries to add/update:")
-			for _, e := range adds {
-				fmt.Printf("  - alias: %s host: %s identity: %s\n", e.Alias, e.HostName, e.IdentityFile)
+		git, err := PlanGitConfig(*base, *gitCfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "status error:", err)
+			os.Exit(1)
+		}
+		var changes []ConfigChange
+		if *showDiff {
+			if changes, err = RenderSync(*base, *cfgPath, *prune); err != nil {
+				fmt.Fprintln(os.Stderr, "status error:", err)
+				os.Exit(1)
 			}
+			changes = append(changes, git.Changes...)
 		}
-		if len(removes) > 0 {
-			fmt.Println("Entries to remove:")
-			for _, a := range removes {
-				fmt.Printf("  - alias: %s\n", a)
+		report := newStatusReport(*cfgPath, ssh, plan, git)
+		if *asJSON {
+			if *showDiff {
+				var sb strings.Builder
+				printConfigDiff(&sb, changes, "sync", false)
+				report.Diff = sb.String()
 			}
+			out, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "status error:", err)
+				os.Exit(1)
+			}
+			fmt.Println(string(out))
+		} else {
+			if report.InSync {
+				fmt.Println("ssh-config is up to date")
+			}
+			printSSHPlan(os.Stdout, *cfgPath, ssh, plan)
+			printGitConfigPlan(os.Stdout, git)
+			if len(changes) > 0 {
+				fmt.Println()
+				printConfigDiff(os.Stdout, changes, "sync", useColor(os.Stdout))
+			}
+		}
+		if *check && !report.InSync {
+			os.Exit(exitPending)
 		}
 	case "sync", "s":
 		syncCmd := flag.NewFlagSet("sync", flag.ExitOnError)
 		syncCmd.Usage = func() {
-			fmt.Fprintf(syncCmd.Output(), "Usage: gitprofiles sync [flags]\n\nApply changes to SSH config.\n\nFlags:\n")
+			fmt.Fprintf(syncCmd.Output(), "Usage: gitprofiles sync [flags]\n       gitprofiles sync --rollback [<snapshot>]\n\nApply changes to SSH config and to the git config of directory identities.\nWith --rollback, restore the SSH config from a snapshot (default: the newest).\n\nFlags:\n")
 			syncCmd.PrintDefaults()
 		}
-		defaultConfig := ""
+		defaultConfig, defaultGitConfig := "", ""
 		if home, err := os.UserHomeDir(); err == nil {
 			defaultConfig = filepath.Join(home, ".ssh", "config")
+			defaultGitConfig = filepath.Join(home, ".gitconfig")
 		}
 		cfgPath := syncCmd.String("config", defaultConfig, "ssh config file path")
 		base := syncCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
 		prune := syncCmd.Bool("prune", true, "remove stale managed entries not present in meta")
+		yes := syncCmd.Bool("yes", false, "update remotes of cloned repositories using renamed aliases without asking")
+		rollback := syncCmd.Bool("rollback", false, "restore the SSH config from a snapshot instead of syncing")
+		drift := syncCmd.String("drift", "", "what to do with hand-modified entries: restore or adopt (default: ask, or restore without a terminal)")
+		gitCfgPath := syncCmd.String("gitconfig", defaultGitConfig, "global git config file path")
 		syncCmd.Parse(os.Args[2:])
+		if *drift != "" && *drift != "restore" && *drift != "adopt" {
+			fmt.Fprintf(os.Stderr, "error: unknown --drift value '%s' (use restore or adopt)\n", *drift)
+			os.Exit(2)
+		}
+		if *rollback {
+			if syncCmd.NArg() > 1 {
+				syncCmd.Usage()
+				os.Exit(2)
+			}
+			restored, saved, err := RollbackSSHConfig(*base, syncCmd.Arg(0))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "sync error:", err)
+				os.Exit(1)
+			}
+			if saved != nil {
+				fmt.Printf("previous ssh-config saved as snapshot %s\n", saved.ID)
+			}
+			fmt.Printf("ssh-config restored from snapshot %s\n", restored.ID)
+			return
+		}
+		ssh, err := PlanSSHConfig(*base, *cfgPath, *prune)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sync error:", err)
+			os.Exit(1)
+		}
+		var adopt []BlockDrift
+		for _, d := range ssh.Drift {
+			switch {
+			case *drift == "adopt":
+				adopt = append(adopt, d)
+			case *drift == "" && term.IsTerminal(int(os.Stdin.Fd())):
+				fmt.Printf("%s in %s was edited by hand:\n", d.Alias, d.Path)
+				for _, l := range driftLines(d) {
+					fmt.Printf("  %s\n", l)
+				}
+				if askOrExit(fmt.Sprintf("Adopt these changes into profile '%s'? (no restores gipo's version)", d.Profile)) {
+					adopt = append(adopt, d)
+				}
+			}
+		}
+		if len(adopt) > 0 {
+			changed, err := AdoptDrift(*base, adopt)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "sync error:", err)
+				os.Exit(1)
+			}
+			for _, name := range changed {
+				fmt.Printf("adopted ssh options into profile '%s'\n", name)
+			}
+		}
 		if err := SyncSSHConfig(*base, *cfgPath, *prune); err != nil {
 			fmt.Fprintln(os.Stderr, "sync error:", err)
 			os.Exit(1)
 		}
 		fmt.Println("ssh-config synced")
+
+		git, err := PlanGitConfig(*base, *gitCfgPath)
+		if err == nil && !git.Empty() {
+			err = SyncGitConfig(*base, *gitCfgPath)
+			if err == nil {
+				fmt.Println("git config synced")
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sync error:", err)
+			os.Exit(1)
+		}
+
+		repos, err := renamedAliasRepos(*base, ssh.Renames)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "sync error:", err)
+			os.Exit(1)
+		}
+		n := 0
+		for _, dirs := range repos {
+			n += len(dirs)
+		}
+		if n == 0 || (!*yes && !askOrExit(fmt.Sprintf("Update remotes of %d cloned repositories to the renamed aliases?", n))) {
+			return
+		}
+		rewriteRenamedRemotes(ssh.Renames, repos)
+	case "sshconfig", "sc":
+		if len(os.Args) < 3 || os.Args[2] != "repair" {
+			fmt.Fprintln(os.Stderr, "Usage: gitprofiles sshconfig repair [flags]")
+			os.Exit(2)
+		}
+		repairCmd := flag.NewFlagSet("sshconfig repair", flag.ExitOnError)
+		repairCmd.Usage = func() {
+			fmt.Fprintf(repairCmd.Output(), "Usage: gitprofiles sshconfig repair [flags]\n\nFix damaged managed blocks in the SSH config: missing END markers, duplicate\nblocks for one alias, nested blocks and Host lines not matching their marker.\nAfter moving the profile store, --reown takes over the blocks of its old\nlocation. The proposed fix is shown before it is applied.\n\nFlags:\n")
+			repairCmd.PrintDefaults()
+		}
+		defaultConfig := ""
+		if home, err := os.UserHomeDir(); err == nil {
+			defaultConfig = filepath.Join(home, ".ssh", "config")
+		}
+		cfgPath := repairCmd.String("config", defaultConfig, "ssh config file path")
+		base := repairCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		yes := repairCmd.Bool("yes", false, "apply the repair without asking")
+		dryRun := repairCmd.Bool("dry-run", false, "only show the repair")
+		reown := repairCmd.String("reown", "", "owner id of this store's old location (see 'gipo status'); its blocks are given to the store")
+		repairCmd.Parse(os.Args[3:])
+
+		repairs, err := PlanRepair(*base, *cfgPath, *reown)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "repair error:", err)
+			os.Exit(1)
+		}
+		if len(repairs) == 0 {
+			fmt.Println("no damaged managed blocks found")
+			return
+		}
+		var changes []ConfigChange
+		for _, r := range repairs {
+			fmt.Printf("%s:\n", r.Path)
+			for _, p := range r.Problems {
+				fmt.Printf("  - %s\n", p)
+			}
+			changes = append(changes, r.ConfigChange)
+		}
+		fmt.Println()
+		printConfigDiff(os.Stdout, changes, "repair", useColor(os.Stdout))
+		if *dryRun || (!*yes && !askOrExit("Apply this repair?")) {
+			return
+		}
+		if _, err := RepairSSHConfig(*base, *cfgPath, *reown); err != nil {
+			fmt.Fprintln(os.Stderr, "repair error:", err)
+			os.Exit(1)
+		}
+		fmt.Println("ssh-config repaired")
+	case "snapshots", "sn":
+		snCmd := flag.NewFlagSet("snapshots", flag.ExitOnError)
+		snCmd.Usage = func() {
+			fmt.Fprintf(snCmd.Output(), "Usage: gitprofiles snapshots [flags]\n\nList the SSH config snapshots taken by sync, newest first.\nRestore one with 'gitprofiles sync --rollback <snapshot>'.\n\nFlags:\n")
+			snCmd.PrintDefaults()
+		}
+		base := snCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		snCmd.Parse(os.Args[2:])
+		snaps, err := ListSnapshots(*base)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "snapshots error:", err)
+			os.Exit(1)
+		}
+		if len(snaps) == 0 {
+			fmt.Println("No snapshots found.")
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(w, "ID\tCREATED\tBEFORE\tFILES")
+		for _, sn := range snaps {
+			var files []string
+			for _, f := range sn.Files {
+				files = append(files, f.Path)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", sn.ID, sn.Created.Local().Format("2006-01-02 15:04:05"), sn.Reason, strings.Join(files, ", "))
+		}
+		w.Flush()
 	case "backup", "b":
 		bCmd := flag.NewFlagSet("backup", flag.ExitOnError)
 		bCmd.Usage = func() {
@@ -324,12 +599,19 @@ func main() {
 	case "clone", "c":
 		cloneCmd := flag.NewFlagSet("clone", flag.ExitOnError)
 		cloneCmd.Usage = func() {
-			fmt.Fprintf(cloneCmd.Output(), "Usage: gitprofiles clone [flags] <repo>\n\nClone a repository using a specific profile and configure local git settings.\n\nArguments:\n  <repo>      Repository to clone (e.g. owner/repo)\n\nFlags:\n")
+			fmt.Fprintf(cloneCmd.Output(), "Usage: gitprofiles clone [flags] <repo> [<dir>] [-- <git clone options>]\n\nClone a repository using a profile and configure local git settings.\nThe profile is chosen by the repository's host unless --profile is given;\nif several profiles serve the host you are asked to pick one.\nWith --ssh-command the canonical URL is cloned and core.sshCommand selects\nthe profile's key, so no SSH config entry is needed.\n\nArguments:\n  <repo>      Repository to clone: owner/repo, gitlab.com/group/repo,\n              https://github.com/owner/repo, git@github.com:owner/repo.git\n              or ssh://git@host:2222/owner/repo.git\n  <dir>       Directory to clone into (default: the repository name)\n\nOptions after -- are passed to git clone, e.g. -- --branch dev --depth 1.\n\nFlags:\n")
 			cloneCmd.PrintDefaults()
 		}
-		profile := cloneCmd.String("profile", "", "profile name to use (required)")
+		profile := cloneCmd.String("profile", "", "profile to clone with (default: the one serving the repository's host)")
+		host := cloneCmd.String("host", "", "host to clone from when the profile has several")
+		sshCommand := cloneCmd.Bool("ssh-command", false, "keep the canonical URL and select the key with core.sshCommand instead of an ssh alias")
 		base := cloneCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
-		cloneCmd.Parse(os.Args[2:])
+		// everything after "--" goes to git clone, wherever it appears
+		flagArgs, gitArgs := os.Args[2:], []string(nil)
+		if i := slices.Index(flagArgs, "--"); i != -1 {
+			flagArgs, gitArgs = flagArgs[:i], flagArgs[i+1:]
+		}
+		cloneCmd.Parse(flagArgs)
 
 		args := cloneCmd.Args()
 		if len(args) < 1 {
@@ -337,37 +619,472 @@ func main() {
 			cloneCmd.Usage()
 			os.Exit(2)
 		}
-		repo := args[0]
-
-		if *profile == "" {
-			fmt.Fprintln(os.Stderr, "error: profile name is required")
+		if len(args) > 2 {
+			fmt.Fprintf(os.Stderr, "error: unexpected argument '%s' (put git clone options after --)\n", args[2])
 			cloneCmd.Usage()
 			os.Exit(2)
 		}
+		repo := args[0]
+		opts := CloneOptions{Host: *host, SSHCommand: *sshCommand, Dir: cloneCmd.Arg(1), GitArgs: gitArgs}
 
-		if err := Clone(*base, *profile, repo); err != nil {
+		_, err := Clone(*base, *profile, repo, opts)
+		var ambiguous *AmbiguousProfileError
+		if errors.As(err, &ambiguous) && term.IsTerminal(int(os.Stdin.Fd())) {
+			question := "Several profiles serve the repository; which one should clone it?"
+			if ambiguous.Host != "" {
+				question = fmt.Sprintf("Several profiles serve %s; which one should clone it?", ambiguous.Host)
+			}
+			name, cerr := choose(question, ambiguous.Profiles)
+			if cerr != nil {
+				fmt.Fprintln(os.Stderr, "clone error:", cerr)
+				os.Exit(1)
+			}
+			_, err = Clone(*base, name, repo, opts)
+		}
+		if err != nil {
 			fmt.Fprintln(os.Stderr, "clone error:", err)
 			os.Exit(1)
 		}
 		fmt.Println("clone and configuration completed")
+	case "use", "u":
+		useCmd := flag.NewFlagSet("use", flag.ExitOnError)
+		useCmd.Usage = func() {
+			fmt.Fprintf(useCmd.Output(), "Usage: gitprofiles use [flags] <profile>\n\nBind the repository in the current directory to a profile: rewrite its ssh\nremotes (url and pushurl) to the profile's alias and set the local user.name\nand user.email. With --ssh-command the remotes keep the canonical host and\ncore.sshCommand selects the profile's key instead. Run it again with another\nprofile, or without --ssh-command, to switch.\n\nArguments:\n  <profile>   Profile name to use\n\nFlags:\n")
+			useCmd.PrintDefaults()
+		}
+		base := useCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		sshCommand := useCmd.Bool("ssh-command", false, "keep canonical remote URLs and select the key with core.sshCommand instead of an ssh alias")
+		useCmd.Parse(os.Args[2:])
+
+		args := useCmd.Args()
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "error: profile argument is required")
+			useCmd.Usage()
+			os.Exit(2)
+		}
+
+		res, err := Use(*base, args[0], ".", *sshCommand)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "use error:", err)
+			os.Exit(1)
+		}
+		for _, c := range res.Remotes {
+			fmt.Printf("%s: %s -> %s\n", c.Key, c.From, c.To)
+		}
+		for _, c := range res.Identity {
+			fmt.Printf("%s: %s -> %s\n", c.Key, orNone(c.From), orNone(c.To))
+		}
+		for _, r := range res.Skipped {
+			fmt.Printf("skipped %s (%s): %s\n", r.Key, r.URL, r.Reason)
+		}
+		switch {
+		case res.Previous != "":
+			fmt.Printf("%s switched from profile '%s' to '%s'\n", res.Dir, res.Previous, args[0])
+		case len(res.Remotes) == 0 && len(res.Identity) == 0:
+			fmt.Printf("%s already uses profile '%s'\n", res.Dir, args[0])
+		default:
+			fmt.Printf("%s now uses profile '%s'\n", res.Dir, args[0])
+		}
+	case "edit", "e":
+		editCmd := flag.NewFlagSet("edit", flag.ExitOnError)
+		editCmd.Usage = func() {
+			fmt.Fprintf(editCmd.Output(), "Usage: gitprofiles edit [flags] <profile>\n\nChange the metadata of an existing profile, keeping its SSH key.\n\nArguments:\n  <profile>   Profile name to edit\n\nFlags:\n")
+			editCmd.PrintDefaults()
+		}
+		defaultConfig, defaultGitConfig := "", ""
+		if home, err := os.UserHomeDir(); err == nil {
+			defaultConfig = filepath.Join(home, ".ssh", "config")
+			defaultGitConfig = filepath.Join(home, ".gitconfig")
+		}
+		cfgPath := editCmd.String("config", defaultConfig, "ssh config file path")
+		base := editCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		email := editCmd.String("email", "", "new email/identity")
+		var hosts, addHosts, removeHosts stringList
+		editCmd.Var(&hosts, "host", "replace the profile's hosts; repeat or comma separate for several (empty to clear)")
+		editCmd.Var(&addHosts, "add-host", "add a host to the profile (repeatable)")
+		editCmd.Var(&removeHosts, "remove-host", "remove a host from the profile (repeatable)")
+		author := editCmd.String("author", "", "new git author name (user.name)")
+		display := editCmd.String("display-name", "", "new human friendly label shown by list")
+		var sshOpts optionList
+		editCmd.Var(&sshOpts, "ssh-option", "set an ssh option as Key=Value, replacing options with the same key (repeatable)")
+		var unsetOpts stringList
+		editCmd.Var(&unsetOpts, "unset-ssh-option", "remove the ssh options with this key (repeatable)")
+		aliasTmpl := editCmd.String("alias-template", "", "ssh alias template for this profile (empty to use the alias.template setting)")
+		var dirs, addDirs, removeDirs stringList
+		editCmd.Var(&dirs, "dir", "replace the directories whose repositories use this profile's identity (empty to clear)")
+		editCmd.Var(&addDirs, "add-dir", "add a directory whose repositories use this profile's identity (repeatable)")
+		editCmd.Var(&removeDirs, "remove-dir", "remove a directory from the profile (repeatable)")
+		gitCfgPath := editCmd.String("gitconfig", defaultGitConfig, "global git config file path")
+		yes := editCmd.Bool("yes", false, "sync the SSH and git config and update cloned repositories without asking")
+		editCmd.Parse(os.Args[2:])
+
+		args := editCmd.Args()
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "error: profile argument is required")
+			editCmd.Usage()
+			os.Exit(2)
+		}
+		name := args[0]
+
+		edit := ProfileEdit{AddHosts: addHosts, RemoveHosts: removeHosts, SetSSHOptions: sshOpts, UnsetSSHOptions: unsetOpts, AddDirs: addDirs, RemoveDirs: removeDirs}
+		editCmd.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "email":
+				edit.Email = email
+			case "host":
+				edit.Hosts = (*[]string)(&hosts)
+			case "author":
+				edit.AuthorName = author
+			case "display-name":
+				edit.DisplayName = display
+			case "alias-template":
+				edit.AliasTemplate = aliasTmpl
+			case "dir":
+				edit.Dirs = (*[]string)(&dirs)
+			}
+		})
+
+		profile, oldAliases, newAliases, err := Edit(*base, name, edit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "edit error:", err)
+			os.Exit(1)
+		}
+		fmt.Println("profile updated")
+		// new directories, or a new email or author of a profile with directories
+		gitPlan, err := PlanGitConfig(*base, *gitCfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "edit error:", err)
+			os.Exit(1)
+		}
+		if !gitPlan.Empty() && (*yes || askOrExit("Sync git config now?")) {
+			if err := SyncGitConfig(*base, *gitCfgPath); err != nil {
+				fmt.Fprintln(os.Stderr, "sync error:", err)
+				os.Exit(1)
+			}
+			fmt.Println("git config synced")
+		}
+		aliasesChanged := !slices.Equal(oldAliases, newAliases)
+		if !aliasesChanged && len(sshOpts) == 0 && len(unsetOpts) == 0 {
+			return
+		}
+
+		// the renames are planned before sync carries them out
+		var renames []AliasRename
+		if aliasesChanged {
+			fmt.Printf("ssh aliases changed: [%s] -> [%s]\n", strings.Join(oldAliases, ", "), strings.Join(newAliases, ", "))
+			ssh, err := PlanSSHConfig(*base, *cfgPath, true)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "edit error:", err)
+				os.Exit(1)
+			}
+			renames = aliasRenames(oldAliases, newAliases, ssh.Renames)
+		}
+		if *yes || askOrExit("Sync SSH config now?") {
+			if err := SyncSSHConfig(*base, *cfgPath, true); err != nil {
+				fmt.Fprintln(os.Stderr, "sync error:", err)
+				os.Exit(1)
+			}
+			fmt.Println("ssh-config synced")
+		}
+
+		repos := make(map[AliasRename][]string)
+		n := 0
+		for _, r := range renames {
+			repos[r] = reposUsingAlias(profile, r.From)
+			n += len(repos[r])
+		}
+		if n == 0 || (!*yes && !askOrExit(fmt.Sprintf("Update remotes of %d cloned repositories?", n))) {
+			return
+		}
+		rewriteRenamedRemotes(renames, repos)
+	case "rotate", "ro":
+		rotCmd := flag.NewFlagSet("rotate", flag.ExitOnError)
+		rotCmd.Usage = func() {
+			fmt.Fprintf(rotCmd.Output(), "Usage: gitprofiles rotate [flags] <profile>\n\nReplace the SSH key of a profile with a new one.\n\nArguments:\n  <profile>   Profile name to rotate\n\nFlags:\n")
+			rotCmd.PrintDefaults()
+		}
+		defaultConfig := ""
+		if home, err := os.UserHomeDir(); err == nil {
+			defaultConfig = filepath.Join(home, ".ssh", "config")
+		}
+		cfgPath := rotCmd.String("config", defaultConfig, "ssh config file path")
+		base := rotCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		algo := rotCmd.String("algo", "", "algorithm for the new key (default: the profile's current algorithm)")
+		grace := rotCmd.Bool("grace", false, "keep the old key as an extra IdentityFile until it is retired")
+		retire := rotCmd.Bool("retire", false, "archive the old keys kept by a previous --grace rotation")
+		usePass := rotCmd.Bool("passphrase", false, "encrypt the new private key with a passphrase (prompted)")
+		passFD := rotCmd.Int("passphrase-fd", -1, "read the passphrase from this file descriptor instead of prompting (implies --passphrase)")
+		format := rotCmd.String("key-format", key.FormatOpenSSH, "private key format for the new key (openssh, pem)")
+		rotCmd.Parse(os.Args[2:])
+
+		args := rotCmd.Args()
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "error: profile argument is required")
+			rotCmd.Usage()
+			os.Exit(2)
+		}
+		name := args[0]
+
+		if *retire {
+			retired, err := Retire(*base, *cfgPath, name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "rotate error:", err)
+				os.Exit(1)
+			}
+			if len(retired) == 0 {
+				fmt.Println("no keys to retire")
+				return
+			}
+			for _, k := range retired {
+				fmt.Println("retired:", k)
+			}
+			return
+		}
+
+		var passBytes []byte
+		if *usePass || *passFD >= 0 {
+			p, err := readNewPassphrase(*passFD)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "passphrase error:", err)
+				os.Exit(1)
+			}
+			passBytes = p
+		}
+		profile, err := Rotate(*base, *cfgPath, name, *algo, *grace, key.Options{Format: *format, Passphrase: passBytes})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "rotate error:", err)
+			os.Exit(1)
+		}
+		pub, err := os.ReadFile(profile.Public)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "rotate error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("private: %s\npublic: %s\n\nRegister this public key with your Git host(s):\n%s\n", profile.Private, profile.Public, strings.TrimSpace(string(pub)))
+		if *grace {
+			fmt.Printf("\nThe old key stays active until you run 'gipo rotate --retire %s'.\n", name)
+		}
+	case "convert", "cv":
+		cvCmd := flag.NewFlagSet("convert", flag.ExitOnError)
+		cvCmd.Usage = func() {
+			fmt.Fprintf(cvCmd.Output(), "Usage: gitprofiles convert [flags] [<profile>...]\n\nRewrite profile private keys in another format. The public keys are unchanged.\n\nArguments:\n  <profile>   Profile names to convert\n\nFlags:\n")
+			cvCmd.PrintDefaults()
+		}
+		base := cvCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		format := cvCmd.String("key-format", key.FormatOpenSSH, "target private key format (openssh, pem)")
+		all := cvCmd.Bool("all", false, "convert the keys of all profiles")
+		cvCmd.Parse(os.Args[2:])
+
+		names := cvCmd.Args()
+		if *all {
+			if *base == "" {
+				home, err := os.UserHomeDir()
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "error getting home dir:", err)
+					os.Exit(1)
+				}
+				*base = filepath.Join(home, ".ssh", "git_profiles")
+			}
+			meta, err := LoadProfiles(*base)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "convert error:", err)
+				os.Exit(1)
+			}
+			names = names[:0]
+			for name, p := range meta {
+				if !p.KeyRef {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+		}
+		if len(names) == 0 {
+			fmt.Fprintln(os.Stderr, "error: profile argument or --all is required")
+			cvCmd.Usage()
+			os.Exit(2)
+		}
+
+		failed := false
+		for _, name := range names {
+			askPassphrase := func() ([]byte, error) {
+				fmt.Fprintf(os.Stderr, "Passphrase for '%s': ", name)
+				p, err := readPassword()
+				fmt.Fprintln(os.Stderr)
+				return p, err
+			}
+			changed, err := Convert(*base, name, *format, askPassphrase)
+			switch {
+			case err != nil:
+				fmt.Fprintf(os.Stderr, "convert error: %s: %v\n", name, err)
+				failed = true
+			case changed:
+				fmt.Printf("%s: converted to %s\n", name, *format)
+			default:
+				fmt.Printf("%s: already %s\n", name, *format)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	case "config", "cf":
+		cfCmd := flag.NewFlagSet("config", flag.ExitOnError)
+		cfCmd.Usage = func() {
+			fmt.Fprintf(cfCmd.Output(), "Usage: gitprofiles config [flags] [<key> [<value>]]\n\nShow or change store-wide settings.\nWithout arguments all settings are shown.\n\nSettings:\n")
+			for _, name := range settingNames() {
+				fmt.Fprintf(cfCmd.Output(), "  %-15s %s\n", name, settingKeys[name].desc)
+			}
+			fmt.Fprintf(cfCmd.Output(), "\nFlags:\n")
+			cfCmd.PrintDefaults()
+		}
+		base := cfCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		unset := cfCmd.Bool("unset", false, "restore the default value of <key>")
+		cfCmd.Parse(os.Args[2:])
+		if *base == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "config error:", err)
+				os.Exit(1)
+			}
+			*base = filepath.Join(home, ".ssh", "git_profiles")
+		}
+
+		args := cfCmd.Args()
+		if len(args) == 2 || (*unset && len(args) == 1) {
+			value := ""
+			if !*unset {
+				value = args[1]
+			}
+			if err := SetSetting(*base, args[0], value); err != nil {
+				fmt.Fprintln(os.Stderr, "config error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if len(args) > 1 || *unset {
+			cfCmd.Usage()
+			os.Exit(2)
+		}
+
+		settings, err := LoadSettings(*base)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "config error:", err)
+			os.Exit(1)
+		}
+		if len(args) == 1 {
+			k, ok := settingKeys[args[0]]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "config error: unknown setting '%s'\n", args[0])
+				os.Exit(1)
+			}
+			fmt.Println(k.get(settings))
+			return
+		}
+		for _, name := range settingNames() {
+			fmt.Printf("%s=%s\n", name, settingKeys[name].get(settings))
+		}
+	case "remove", "rm":
+		rmCmd := flag.NewFlagSet("remove", flag.ExitOnError)
+		rmCmd.Usage = func() {
+			fmt.Fprintf(rmCmd.Output(), "Usage: gitprofiles remove [flags] <profile>\n\nRemove a profile, its SSH key pair and its SSH config entry.\n\nArguments:\n  <profile>   Profile name to remove\n\nFlags:\n")
+			rmCmd.PrintDefaults()
+		}
+		defaultConfig := ""
+		if home, err := os.UserHomeDir(); err == nil {
+			defaultConfig = filepath.Join(home, ".ssh", "config")
+		}
+		cfgPath := rmCmd.String("config", defaultConfig, "ssh config file path")
+		base := rmCmd.String("base", os.Getenv(envDir), "base directory for gitprofiles (overrides HOME)")
+		shred := rmCmd.Bool("shred", false, "overwrite and delete the key pair instead of archiving it under backups/keys")
+		force := rmCmd.Bool("force", false, "remove even if cloned repositories still use the profile's alias or key")
+		yes := rmCmd.Bool("yes", false, "do not ask for confirmation")
+		rmCmd.Parse(os.Args[2:])
+
+		args := rmCmd.Args()
+		if len(args) < 1 {
+			fmt.Fprintln(os.Stderr, "error: profile argument is required")
+			rmCmd.Usage()
+			os.Exit(2)
+		}
+		name := args[0]
+
+		if !*yes {
+			question := fmt.Sprintf("Remove profile '%s'", name)
+			if *shred {
+				question += " and shred its keys"
+			}
+			inUse, err := profileRepos(*base, name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "remove error:", err)
+				os.Exit(1)
+			}
+			if len(inUse) > 0 {
+				question += fmt.Sprintf(" (still used by %s)", strings.Join(inUse, ", "))
+			}
+			if !askOrExit(question + "?") {
+				fmt.Println("aborted")
+				return
+			}
+		}
+
+		if err := Remove(*base, *cfgPath, name, *shred, *force); err != nil {
+			fmt.Fprintln(os.Stderr, "remove error:", err)
+			os.Exit(1)
+		}
+		fmt.Println("profile removed")
 	default:
 		printUsage()
 		os.Exit(2)
 	}
 }
 
+// rewriteRenamedRemotes points the remotes of repos, per rename, at the new alias and
+// prints each changed url. Failures are reported as warnings.
+func rewriteRenamedRemotes(renames []AliasRename, repos map[AliasRename][]string) {
+	for _, r := range renames {
+		for _, dir := range repos[r] {
+			changed, err := rewriteRemoteAlias(dir, r.From, r.To)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "warning:", err)
+				continue
+			}
+			for _, k := range changed {
+				fmt.Printf("  %s: updated %s\n", dir, k)
+			}
+		}
+	}
+}
+
+// askOrExit asks a yes/no question and exits the program if stdin can't be read.
+func askOrExit(question string) bool {
+	ok, err := confirm(question)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "\nerror reading answer:", err)
+		os.Exit(1)
+	}
+	return ok
+}
+
 func printUsage() {
 	fmt.Println("GitProfiles - Manage multiple git profiles and SSH keys")
 	fmt.Println("\nUsage:")
 	fmt.Println("  gitprofiles <command> [flags]")
 	fmt.Println("\nCommands:")
-	fmt.Println("  init (i)    Initialize the gitprofiles directory structure")
-	fmt.Println("  add (a)     Create a new git profile with an SSH key")
-	fmt.Println("  list (l)    List all available profiles")
-	fmt.Println("  backup (b)  Create an encrypted backup of profiles")
-	fmt.Println("  restore (r) Restore profiles from an encrypted backup")
-	fmt.Println("  clone (c)   Clone a repository using a specific profile")
-	fmt.Println("  sync (s)    Apply changes to SSH config")
-	fmt.Println("  status (t)  Preview changes to SSH config")
+	fmt.Println("  init (i)       Initialize the gitprofiles directory structure")
+	fmt.Println("  add (a)        Create a new git profile with an SSH key")
+	fmt.Println("  edit (e)       Change metadata of an existing profile")
+	fmt.Println("  import (im)    Create a profile from an existing SSH key")
+	fmt.Println("  list (l)       List all available profiles")
+	fmt.Println("  remove (rm)    Remove a profile and its SSH key pair")
+	fmt.Println("  rotate (ro)    Replace the SSH key of a profile")
+	fmt.Println("  backup (b)     Create an encrypted backup of profiles")
+	fmt.Println("  restore (r)    Restore profiles from an encrypted backup")
+	fmt.Println("  clone (c)      Clone a repository using a specific profile")
+	fmt.Println("  use (u)        Bind an existing repository to a profile")
+	fmt.Println("  config (cf)    Show or change store-wide settings")
+	fmt.Println("  convert (cv)   Rewrite private keys in another format")
+	fmt.Println("  sync (s)       Apply changes to SSH config")
+	fmt.Println("  snapshots (sn) List SSH config snapshots taken by sync")
+	fmt.Println("  status (t)     Preview changes to SSH config")
+	fmt.Println("  sshconfig (sc) Repair damaged managed blocks ('sshconfig repair')")
 	fmt.Println("\nUse 'gitprofiles <command> -h' for more information about a command.")
 }
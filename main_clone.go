@@ -2,18 +2,42 @@ package main
 
 import (
 	"fmt"
+	"maps"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
+// CloneOptions are the optional settings of Clone.
+type CloneOptions struct {
+	// Host selects which of the profile's hosts to clone from when the repository doesn't
+	// name one and the profile has several.
+	Host string
+	// SSHCommand clones the canonical URL (git@github.com:owner/repo.git) instead of the
+	// profile's alias, and sets core.sshCommand to select the profile's key (see
+	// Profile.sshCommand), marked with gipo.profile so it is kept up to date.
+	SSHCommand bool
+	// Dir is the directory to clone into. Empty means the repository name, like git,
+	// with ".git" appended for --bare and --mirror clones.
+	Dir string
+	// GitArgs are extra options for git clone, e.g. --branch, --depth or --bare.
+	GitArgs []string
+}
+
 // Clone clones a repository using the specified profile and configures local git settings.
-func Clone(baseDir, profileName, repoArg string) error {
+// repoArg is "owner/repo", "host/owner/repo" or a full URL: https://host/owner/repo,
+// git@host:owner/repo.git or ssh://git@host/owner/repo. profileName may be empty if exactly
+// one profile serves the repository's host; with several, an *AmbiguousProfileError lists
+// them. It returns the absolute path of the new repository.
+func Clone(baseDir, profileName, repoArg string, opts CloneOptions) (string, error) {
 	if baseDir == "" {
 		home, err := os.UserHomeDir()
 		if err != nil {
-			return err
+			return "", err
 		}
 		baseDir = filepath.Join(home, ".ssh", "git_profiles")
 	}
@@ -21,64 +45,316 @@ func Clone(baseDir, profileName, repoArg string) error {
 	// Load profile
 	meta, err := LoadProfiles(baseDir)
 	if err != nil {
-		return fmt.Errorf("failed to read profiles: %w", err)
+		return "", fmt.Errorf("failed to read profiles: %w", err)
 	}
 
-	profile, ok := meta[profileName]
-	if !ok {
-		return fmt.Errorf("profile '%s' not found", profileName)
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return "", err
 	}
 
-	host := profile["host"]
-	email := profile["email"]
-	if host == "" {
-		return fmt.Errorf("profile '%s' has no host defined", profileName)
+	ref, err := parseRepoRef(repoArg)
+	if err != nil {
+		return "", err
 	}
+	profileName, host, ref, err := resolveCloneProfile(meta, settings.AliasTemplate, profileName, opts.Host, ref)
+	if err != nil {
+		return "", err
+	}
+	profile := meta[profileName]
+	email := profile.Email
 
 	// Construct SSH config alias
-	// This must match the logic in PreviewSSHConfig
-	alias := fmt.Sprintf("git-%s-%s", profileName, strings.ReplaceAll(host, ".", "-"))
+	alias := profile.alias(settings.AliasTemplate, host)
 
 	// Construct Clone URL: git@alias:repo.git
-	cloneURL := fmt.Sprintf("git@%s:%s.git", alias, repoArg)
+	cloneURL := ref.cloneURL(alias)
+	args := []string{"clone"}
+	if opts.SSHCommand {
+		// -c also stores the setting in the new repository
+		cloneURL = ref.cloneURL(host)
+		args = append(args, "-c", "core.sshCommand="+profile.sshCommand(), "-c", sshCommandProfileKey+"="+profileName)
+	}
+
+	// The directory is always passed to git, so it is known without parsing git's output.
+	dirName := opts.Dir
+	if dirName == "" {
+		dirName = cloneDirName(ref, opts.GitArgs)
+	}
+	args = append(args, opts.GitArgs...)
+	args = append(args, "--", cloneURL, dirName)
 
 	fmt.Printf("Cloning %s...\n", cloneURL)
 
-	cmd := exec.Command("git", "clone", cloneURL)
+	cmd := exec.Command("git", args...)
+	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("git clone failed: %w", err)
+		return "", fmt.Errorf("git clone failed: %w", err)
 	}
 
-	// Determine directory name
-	// repoArg is typically "owner/repo", so we take the last part
-	parts := strings.Split(repoArg, "/")
-	dirName := parts[len(parts)-1]
-	dirName = strings.TrimSuffix(dirName, ".git")
+	// Check if the repository exists (it should after clone)
+	dir, err := filepath.Abs(dirName)
+	if err != nil {
+		return "", err
+	}
+	check := exec.Command("git", "rev-parse", "--git-dir")
+	check.Dir = dir
+	if err := check.Run(); err != nil {
+		return "", fmt.Errorf("cloned repository '%s' not found", dirName)
+	}
 
-	// Check if directory exists (it should after clone)
-	if _, err := os.Stat(dirName); os.IsNotExist(err) {
-		return fmt.Errorf("cloned directory '%s' not found", dirName)
+	userName, fallback := profile.gitUserName()
+	if fallback {
+		fmt.Fprintf(os.Stderr, "warning: profile '%s' has no author name; using the profile name as user.name (set one with 'gipo edit --author')\n", profileName)
 	}
 
 	fmt.Printf("Configuring local git config for '%s'...\n", dirName)
-	fmt.Printf("  user.name: %s\n", profileName)
+	fmt.Printf("  user.name: %s\n", userName)
 	fmt.Printf("  user.email: %s\n", email)
+	if opts.SSHCommand {
+		fmt.Printf("  core.sshCommand: %s\n", profile.sshCommand())
+	}
+	if _, err := setLocalIdentity(dir, profile); err != nil {
+		return dir, err
+	}
+
+	// Remember the repository so that remove/edit can find checkouts using this profile.
+	if _, err := recordRepo(baseDir, profileName, dir); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to record repository in profile: %v\n", err)
+	}
+
+	return dir, nil
+}
+
+// cloneDirName returns the directory git clone would pick for ref: the last segment of
+// its path, with ".git" for --bare and --mirror clones.
+func cloneDirName(ref repoRef, gitArgs []string) string {
+	name := path.Base(ref.Path)
+	if slices.Contains(gitArgs, "--bare") || slices.Contains(gitArgs, "--mirror") {
+		name += ".git"
+	}
+	return name
+}
+
+// repoRef is a repository as given to clone.
+type repoRef struct {
+	// User is the login of an ssh URL, e.g. "git"; empty for other references.
+	User string
+	// Host is the host or ssh alias named by the reference; empty for "owner/repo".
+	Host string
+	// Port is the port of an ssh:// URL, if any.
+	Port string
+	// Path is the repository path without ".git" suffix, e.g. "org/repo". The leading slash
+	// of an ssh path is kept, since "host:/srv/repo" and "host:srv/repo" are different
+	// repositories; for https and plain paths it is dropped.
+	Path string
+}
+
+// parseRepoRef parses an https://, http://, ssh:// or git:// URL, an scp-style
+// "[user@]host:path" or a plain "owner/repo" path. For plain paths a leading host such as
+// "gitlab.com/group/repo" is only recognized by resolveCloneProfile, which knows the hosts.
+func parseRepoRef(arg string) (repoRef, error) {
+	var ref repoRef
+	sshPath := true
+	switch {
+	case strings.Contains(arg, "://"):
+		u, err := url.Parse(arg)
+		if err != nil {
+			return ref, fmt.Errorf("invalid repository URL '%s': %w", arg, err)
+		}
+		switch u.Scheme {
+		case "https", "http", "git":
+			sshPath = false
+		case "ssh", "git+ssh", "ssh+git":
+			ref.User, ref.Port = u.User.Username(), u.Port()
+		default:
+			return ref, fmt.Errorf("unsupported repository URL scheme '%s'", u.Scheme)
+		}
+		ref.Host, ref.Path = u.Hostname(), u.Path
+	default:
+		// scp-style if there is a colon before the first slash, as git decides
+		colon, slash := strings.Index(arg, ":"), strings.Index(arg, "/")
+		if colon > 0 && (slash == -1 || colon < slash) {
+			ref.Host, ref.Path = arg[:colon], arg[colon+1:]
+			if u, h, ok := strings.Cut(ref.Host, "@"); ok {
+				ref.User, ref.Host = u, h
+			}
+		} else {
+			ref.Path, sshPath = arg, false
+		}
+	}
+	ref.Path = strings.TrimRight(ref.Path, "/")
+	if !sshPath {
+		ref.Path = strings.TrimLeft(ref.Path, "/")
+	}
+	ref.Path = strings.TrimSuffix(ref.Path, ".git")
+	if ref.Path == "" || (ref.Host == "" && strings.Contains(arg, "://")) {
+		return ref, fmt.Errorf("invalid repository '%s'", arg)
+	}
+	return ref, nil
+}
+
+// cloneURL returns the ssh URL of the repository through alias. The user defaults to "git".
+func (r repoRef) cloneURL(alias string) string {
+	user := r.User
+	if user == "" {
+		user = "git"
+	}
+	if r.Port != "" && r.Port != "22" {
+		return fmt.Sprintf("ssh://%s@%s:%s/%s.git", user, alias, r.Port, strings.TrimPrefix(r.Path, "/"))
+	}
+	return fmt.Sprintf("%s@%s:%s.git", user, alias, r.Path)
+}
+
+// AmbiguousProfileError reports that several profiles can clone a repository.
+type AmbiguousProfileError struct {
+	Host     string
+	Profiles []string
+}
+
+func (e *AmbiguousProfileError) Error() string {
+	what := "the repository"
+	if e.Host != "" {
+		what = e.Host
+	}
+	return fmt.Sprintf("several profiles serve %s (%s); choose one with --profile", what, strings.Join(e.Profiles, ", "))
+}
 
-	// git config --local user.name <profileName>
-	configNameCmd := exec.Command("git", "config", "--local", "user.name", profileName)
-	configNameCmd.Dir = dirName
-	if err := configNameCmd.Run(); err != nil {
-		return fmt.Errorf("failed to set user.name: %w", err)
+// resolveCloneProfile picks the profile and host to clone ref with. profileName and host
+// are the --profile and --host flags and may be empty. The returned ref has its host
+// removed from a "host/owner/repo" path. A host that is one of gipo's own aliases selects
+// its profile and host.
+func resolveCloneProfile(meta map[string]*Profile, aliasTemplate, profileName, host string, ref repoRef) (string, string, repoRef, error) {
+	names := slices.Sorted(maps.Keys(meta))
+	if profileName != "" {
+		if _, ok := meta[profileName]; !ok {
+			return "", "", ref, fmt.Errorf("profile '%s' not found", profileName)
+		}
+		names = []string{profileName}
 	}
 
-	// git config --local user.email <email>
-	configEmailCmd := exec.Command("git", "config", "--local", "user.email", email)
-	configEmailCmd.Dir = dirName
-	if err := configEmailCmd.Run(); err != nil {
-		return fmt.Errorf("failed to set user.email: %w", err)
+	// "gitlab.com/group/repo" names its host if a candidate profile has it
+	if first, rest, ok := strings.Cut(ref.Path, "/"); ok && ref.Host == "" {
+		for _, name := range names {
+			if slices.Contains(meta[name].Hosts, first) {
+				ref.Host, ref.Path = first, rest
+				break
+			}
+		}
 	}
 
-	return nil
+	// a remote copied from a repository cloned by gipo uses the alias
+alias:
+	for _, name := range names {
+		for _, h := range meta[name].Hosts {
+			if ref.Host != "" && meta[name].alias(aliasTemplate, h) == ref.Host {
+				names, ref.Host = []string{name}, h
+				break alias
+			}
+		}
+	}
+
+	if ref.Host != "" && host != "" && host != ref.Host {
+		return "", "", ref, fmt.Errorf("repository host '%s' does not match --host '%s'", ref.Host, host)
+	}
+	if ref.Host == "" {
+		ref.Host = host
+	}
+
+	var candidates []string
+	for _, name := range names {
+		p := meta[name]
+		if (ref.Host == "" && len(p.Hosts) > 0) || slices.Contains(p.Hosts, ref.Host) {
+			candidates = append(candidates, name)
+		}
+	}
+	switch {
+	case profileName != "":
+		// the profile reports a host it doesn't have
+		candidates = names
+	case len(candidates) == 0 && ref.Host != "":
+		return "", "", ref, fmt.Errorf("no profile serves host '%s'; add it to a profile or choose one with --profile", ref.Host)
+	case len(candidates) == 0:
+		return "", "", ref, fmt.Errorf("no profile has a host defined")
+	case len(candidates) > 1:
+		return "", "", ref, &AmbiguousProfileError{Host: ref.Host, Profiles: candidates}
+	}
+
+	h, err := meta[candidates[0]].resolveHost(ref.Host)
+	if err != nil {
+		return "", "", ref, err
+	}
+	return candidates[0], h, ref, nil
+}
+
+// setLocalIdentity sets user.name and user.email of the repository at dir to those of
+// the profile. It returns the keys whose value changed, with their old and new values.
+func setLocalIdentity(dir string, profile *Profile) ([]gitConfigChange, error) {
+	userName, _ := profile.gitUserName()
+	return setLocalConfig(dir, [][2]string{{"user.name", userName}, {"user.email", profile.Email}})
+}
+
+// setLocalConfig sets the given keys in the local config of the repository at dir; an
+// empty value unsets the key. It returns the keys whose value changed.
+func setLocalConfig(dir string, values [][2]string) ([]gitConfigChange, error) {
+	var changed []gitConfigChange
+	for _, kv := range values {
+		old := localConfig(dir, kv[0])
+		if old == kv[1] {
+			continue
+		}
+		set := exec.Command("git", "config", "--local", kv[0], kv[1])
+		if kv[1] == "" {
+			set = exec.Command("git", "config", "--local", "--unset-all", kv[0])
+		}
+		set.Dir = dir
+		if err := set.Run(); err != nil {
+			return changed, fmt.Errorf("failed to set %s: %w", kv[0], err)
+		}
+		changed = append(changed, gitConfigChange{Key: kv[0], From: old, To: kv[1]})
+	}
+	return changed, nil
+}
+
+// gitConfigChange is a git config value changed by gipo.
+type gitConfigChange struct {
+	Key  string
+	From string
+	To   string
+}
+
+// recordRepo adds dir to the repositories of a profile and drops it from any other
+// profile, returning the name of that profile. keys.json is re-read under the lock
+// because it may have changed while git was cloning.
+func recordRepo(baseDir, profileName, dir string) (string, error) {
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return "", err
+	}
+	profile, ok := meta[profileName]
+	if !ok {
+		return "", fmt.Errorf("profile '%s' not found", profileName)
+	}
+	previous := ""
+	for name, p := range meta {
+		if name != profileName && slices.Contains(p.Repos, dir) {
+			p.Repos = slices.DeleteFunc(p.Repos, func(r string) bool { return r == dir })
+			previous = name
+		}
+	}
+	if previous == "" && slices.Contains(profile.Repos, dir) {
+		return "", nil
+	}
+	if !slices.Contains(profile.Repos, dir) {
+		profile.Repos = append(profile.Repos, dir)
+	}
+	return previous, SaveProfiles(baseDir, meta)
 }
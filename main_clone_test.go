@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseRepoRef(t *testing.T) {
+	tests := []struct {
+		in   string
+		want repoRef
+	}{
+		{"owner/repo", repoRef{Path: "owner/repo"}},
+		{"gitlab.com/group/sub/repo.git", repoRef{Path: "gitlab.com/group/sub/repo"}},
+		{"https://github.com/owner/repo", repoRef{Host: "github.com", Path: "owner/repo"}},
+		{"https://github.com/owner/repo.git/", repoRef{Host: "github.com", Path: "owner/repo"}},
+		{"https://token@github.com:8443/owner/repo", repoRef{Host: "github.com", Path: "owner/repo"}},
+		{"git@github.com:owner/repo.git", repoRef{User: "git", Host: "github.com", Path: "owner/repo"}},
+		{"github.com:owner/repo", repoRef{Host: "github.com", Path: "owner/repo"}},
+		{"ssh://git@git.example.com:2222/group/repo.git", repoRef{User: "git", Host: "git.example.com", Port: "2222", Path: "/group/repo"}},
+		{"ssh://git@github.com/owner/repo", repoRef{User: "git", Host: "github.com", Path: "/owner/repo"}},
+		{"git@server:/srv/git/project.git", repoRef{User: "git", Host: "server", Path: "/srv/git/project"}},
+		{"ssh://git@server/srv/git/project/", repoRef{User: "git", Host: "server", Path: "/srv/git/project"}},
+	}
+	for _, tt := range tests {
+		got, err := parseRepoRef(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("parseRepoRef(%q) = %#v, %v; want %#v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "https://github.com/", "ftp://host/repo"} {
+		if _, err := parseRepoRef(bad); err == nil {
+			t.Errorf("parseRepoRef(%q) accepted", bad)
+		}
+	}
+
+	if got := (repoRef{Path: "o/r"}).cloneURL("a"); got != "git@a:o/r.git" {
+		t.Errorf("cloneURL = %s", got)
+	}
+	if got := (repoRef{User: "org-1", Port: "2222", Path: "/o/r"}).cloneURL("a"); got != "ssh://org-1@a:2222/o/r.git" {
+		t.Errorf("cloneURL with port = %s", got)
+	}
+	if got := (repoRef{Path: "/srv/git/project"}).cloneURL("a"); got != "git@a:/srv/git/project.git" {
+		t.Errorf("cloneURL with absolute path = %s", got)
+	}
+}
+
+func TestResolveCloneProfile(t *testing.T) {
+	meta := map[string]*Profile{
+		"work":     {Name: "work", Hosts: []string{"github.com", "gitlab.com"}},
+		"personal": {Name: "personal", Hosts: []string{"github.com"}},
+		"corp":     {Name: "corp", Hosts: []string{"git.corp.example"}},
+	}
+	resolve := func(profile, host, repo string) (string, string, repoRef, error) {
+		ref, err := parseRepoRef(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resolveCloneProfile(meta, "", profile, host, ref)
+	}
+
+	tests := []struct {
+		profile, host, repo   string
+		wantProfile, wantHost string
+		wantPath              string
+	}{
+		{"", "", "https://git.corp.example/team/repo", "corp", "git.corp.example", "team/repo"},
+		{"", "", "git@gitlab.com:group/repo.git", "work", "gitlab.com", "group/repo"},
+		{"", "", "gitlab.com/group/repo", "work", "gitlab.com", "group/repo"},
+		{"personal", "", "https://github.com/owner/repo", "personal", "github.com", "owner/repo"},
+		{"work", "gitlab.com", "group/repo", "work", "gitlab.com", "group/repo"},
+		// gipo's own alias picks its profile
+		{"", "", "git@git-personal-github-com:owner/repo.git", "personal", "github.com", "owner/repo"},
+	}
+	for _, tt := range tests {
+		name, host, ref, err := resolve(tt.profile, tt.host, tt.repo)
+		if err != nil || name != tt.wantProfile || host != tt.wantHost || ref.Path != tt.wantPath {
+			t.Errorf("%s (--profile %q): got %s %s %s (%v)", tt.repo, tt.profile, name, host, ref.Path, err)
+		}
+	}
+
+	var ambiguous *AmbiguousProfileError
+	if _, _, _, err := resolve("", "", "https://github.com/owner/repo"); !errors.As(err, &ambiguous) ||
+		ambiguous.Host != "github.com" || len(ambiguous.Profiles) != 2 {
+		t.Errorf("expected both github.com profiles offered, got %v", err)
+	}
+	if _, _, _, err := resolve("", "", "https://bitbucket.org/owner/repo"); err == nil {
+		t.Error("expected an error for a host no profile serves")
+	}
+	if _, _, _, err := resolve("corp", "", "https://github.com/owner/repo"); err == nil {
+		t.Error("expected an error for a profile without the URL's host")
+	}
+	if _, _, _, err := resolve("", "gitlab.com", "https://github.com/owner/repo"); err == nil {
+		t.Error("expected an error when --host contradicts the URL")
+	}
+}
+
+func TestCloneOptions(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	d, _ := newStore(t)
+
+	// an upstream with a second branch, reached through the alias by url.insteadOf
+	upstream := filepath.Join(t.TempDir(), "upstream")
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git(".", "init", "-q", upstream)
+	git(upstream, "-c", "user.name=x", "-c", "user.email=x@example.com", "commit", "-q", "--allow-empty", "-m", "init")
+	git(upstream, "branch", "dev")
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "url.file://"+filepath.ToSlash(upstream)+".insteadOf")
+	t.Setenv("GIT_CONFIG_VALUE_0", "git@git-work-github-com:acme/repo.git")
+
+	target := filepath.Join(t.TempDir(), "checkout")
+	dir, err := Clone(d, "work", "acme/repo", CloneOptions{Dir: target, GitArgs: []string{"--branch", "dev", "--depth", "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != target || git(dir, "branch", "--show-current") != "dev" || git(dir, "config", "--local", "user.email") != "me@company.com" {
+		t.Fatalf("unexpected clone in %s", dir)
+	}
+
+	// a bare clone gets git's default name and is configured too
+	t.Chdir(t.TempDir())
+	dir, err = Clone(d, "work", "git@github.com:acme/repo.git", CloneOptions{GitArgs: []string{"--bare"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(dir) != "repo.git" || git(dir, "config", "--local", "user.email") != "me@company.com" {
+		t.Fatalf("unexpected bare clone in %s", dir)
+	}
+	meta, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(meta["work"].Repos, []string{target, dir}) {
+		t.Fatalf("repositories not recorded: %v", meta["work"].Repos)
+	}
+}
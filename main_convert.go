@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/snowmerak/gipo/fsutil"
+	"github.com/snowmerak/gipo/key"
+	"golang.org/x/crypto/ssh"
+)
+
+// Convert rewrites the private key of a profile in format (key.FormatOpenSSH or key.FormatPEM).
+// The key material, and therefore the public key, is unchanged. passphrase is called only
+// for encrypted keys; they stay encrypted with the same passphrase.
+// It reports whether the file was rewritten (false if it already was in format).
+func Convert(baseDir, profileName, format string, passphrase func() ([]byte, error)) (bool, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return false, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	profile, ok := meta[profileName]
+	if !ok {
+		return false, fmt.Errorf("profile '%s' not found", profileName)
+	}
+	if profile.KeyRef {
+		return false, fmt.Errorf("profile '%s' references %s; gipo does not rewrite referenced keys", profileName, profile.Private)
+	}
+
+	data, err := os.ReadFile(profile.Private)
+	if err != nil {
+		return false, err
+	}
+	current, err := key.Format(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", profile.Private, err)
+	}
+	if current == format {
+		return false, nil
+	}
+
+	pubBefore, err := key.ParsePrivateKey(data, nil)
+	opts := key.Options{Format: format}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == nil {
+			return false, fmt.Errorf("%s is passphrase protected", profile.Private)
+		}
+		if opts.Passphrase, err = passphrase(); err != nil {
+			return false, err
+		}
+		pubBefore, err = key.ParsePrivateKey(data, opts.Passphrase)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	converted, err := key.ConvertPrivateKey(data, fmt.Sprintf("%s@%s", profileName, profile.Email), opts)
+	if err != nil {
+		return false, err
+	}
+	pubAfter, err := key.ParsePrivateKey(converted, opts.Passphrase)
+	if err != nil {
+		return false, err
+	}
+	if string(pubBefore.Marshal()) != string(pubAfter.Marshal()) {
+		return false, errors.New("converted key does not match the original public key")
+	}
+
+	if err := fsutil.WriteFile(profile.Private, converted, 0o600); err != nil {
+		return false, err
+	}
+	return true, nil
+}
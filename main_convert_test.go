@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/snowmerak/gipo/key"
+)
+
+func TestConvert(t *testing.T) {
+	d := t.TempDir()
+	if err := Init(d); err != nil {
+		t.Fatal(err)
+	}
+	priv, pub, err := Add(d, "p256", Profile{Name: "alice", Email: "alice@example.com"}, key.Options{Format: key.FormatPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBefore, _ := os.ReadFile(pub)
+
+	changed, err := Convert(d, "alice", key.FormatOpenSSH, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected key to be converted")
+	}
+	b, _ := os.ReadFile(priv)
+	if f, _ := key.Format(b); f != key.FormatOpenSSH {
+		t.Fatalf("expected openssh key, got %s", f)
+	}
+	if pubAfter, _ := os.ReadFile(pub); string(pubAfter) != string(pubBefore) {
+		t.Fatal("public key file changed")
+	}
+
+	changed, err = Convert(d, "alice", key.FormatOpenSSH, nil)
+	if err != nil || changed {
+		t.Fatalf("expected no-op, got changed=%v err=%v", changed, err)
+	}
+
+	// encrypted keys stay encrypted and can't be written as pem
+	if _, _, err := Add(d, "ed25519", Profile{Name: "bob", Email: "bob@example.com"}, key.Options{Passphrase: []byte("secret")}); err != nil {
+		t.Fatal(err)
+	}
+	ask := func() ([]byte, error) { return []byte("secret"), nil }
+	if _, err := Convert(d, "bob", key.FormatPEM, ask); err == nil {
+		t.Fatal("expected error converting an encrypted key to pem")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+// AdoptDrift makes the hand edits of drifted blocks part of their profiles: the directives
+// after IdentityFile become the profile's ssh options. Edits to Host, HostName, User and
+// IdentityFile, and comments, can't be kept and are restored by the next sync. The
+// core.sshCommand gipo set in the changed profiles' repositories is updated too.
+// It returns the profiles that changed.
+func AdoptDrift(baseDir string, drift []BlockDrift) ([]string, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	var changed []string
+	for _, d := range drift {
+		p, ok := meta[d.Profile]
+		if !ok {
+			return nil, fmt.Errorf("profile '%s' not found", d.Profile)
+		}
+		entries := sshconfig.Entries(d.Current)
+		if len(entries) != 1 {
+			return nil, fmt.Errorf("can't read the managed block of %s", d.Alias)
+		}
+		opts := adoptedOptions(entries[0].Options)
+		if slices.Equal(opts, p.SSHOptions) {
+			continue
+		}
+		p.SSHOptions = opts
+		if !slices.Contains(changed, d.Profile) {
+			changed = append(changed, d.Profile)
+		}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	if err := SaveProfiles(baseDir, meta); err != nil {
+		return nil, err
+	}
+	for _, name := range changed {
+		if err := refreshSSHCommands(meta[name]); err != nil {
+			return changed, fmt.Errorf("options adopted but core.sshCommand was not updated: %w", err)
+		}
+	}
+	return changed, nil
+}
+
+// adoptedOptions turns the options of a hand-edited block into profile ssh options.
+// gipo writes "IdentitiesOnly yes" by default, so it is dropped, and a deleted
+// IdentitiesOnly becomes an explicit "IdentitiesOnly no", ssh's own default.
+func adoptedOptions(opts []sshconfig.Option) []sshconfig.Option {
+	var out []sshconfig.Option
+	identitiesOnly := false
+	for _, o := range opts {
+		// directives a profile can't hold, e.g. a stray Match or Include
+		if _, err := sshconfig.ParseOption(o.Key + " " + o.Value); err != nil {
+			continue
+		}
+		if strings.EqualFold(o.Key, "IdentitiesOnly") {
+			identitiesOnly = true
+			if strings.EqualFold(o.Value, "yes") {
+				continue
+			}
+		}
+		out = append(out, o)
+	}
+	if !identitiesOnly {
+		out = append(out, sshconfig.Option{Key: "IdentitiesOnly", Value: "no"})
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+func TestPlanSSHConfigDrift(t *testing.T) {
+	d, cfg := newSyncedStore(t)
+	synced, _ := os.ReadFile(cfg)
+
+	// deleting the default IdentitiesOnly leaves the parsed entry equal, but not the block
+	edited := strings.Replace(string(synced), "    IdentitiesOnly yes\n", "    Port 2200\n", 1)
+	os.WriteFile(cfg, []byte(edited), 0o600)
+
+	plan, err := PlanSSHConfig(d, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Drift) != 1 || plan.Drift[0].Alias != "git-work-github-com" || plan.Drift[0].Profile != "work" {
+		t.Fatalf("expected drift for the edited block, got %#v", plan.Drift)
+	}
+	want := []string{"-    IdentitiesOnly yes", "+    Port 2200"}
+	if got := driftLines(plan.Drift[0]); !slices.Equal(got, want) {
+		t.Fatalf("drift lines = %q, want %q", got, want)
+	}
+
+	// restoring is what sync does by default
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(cfg); string(b) != string(synced) {
+		t.Fatalf("expected block restored, got:\n%s", b)
+	}
+
+	// adopting moves the edits into the profile, and into gipo's core.sshCommand
+	var repo string
+	if _, err := exec.LookPath("git"); err == nil {
+		repo = filepath.Join(t.TempDir(), "repo")
+		if out, err := exec.Command("git", "init", "-q", repo).CombinedOutput(); err != nil {
+			t.Fatalf("git init: %v: %s", err, out)
+		}
+		if _, err := Use(d, "work", repo, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(cfg, []byte(edited), 0o600)
+	plan, err = PlanSSHConfig(d, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := AdoptDrift(d, plan.Drift)
+	if err != nil || !slices.Equal(changed, []string{"work"}) {
+		t.Fatalf("AdoptDrift = %v, %v", changed, err)
+	}
+	meta, _ := LoadProfiles(d)
+	wantOpts := []sshconfig.Option{{Key: "Port", Value: "2200"}, {Key: "IdentitiesOnly", Value: "no"}}
+	if !slices.Equal(meta["work"].SSHOptions, wantOpts) {
+		t.Fatalf("adopted options = %#v, want %#v", meta["work"].SSHOptions, wantOpts)
+	}
+	if repo != "" {
+		if got := localConfig(repo, "core.sshCommand"); got != meta["work"].sshCommand() || !strings.Contains(got, "Port=2200") {
+			t.Fatalf("core.sshCommand not refreshed: %s", got)
+		}
+	}
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if plan, err := PlanSSHConfig(d, cfg, true); err != nil || len(plan.Drift) != 0 || len(plan.Adds) != 0 {
+		t.Fatalf("expected nothing to do after adopting, got %#v (%v)", plan, err)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+// ProfileEdit holds the fields to change on an existing profile.
+// Nil fields are left untouched.
+type ProfileEdit struct {
+	Email *string
+	// Hosts replaces the whole host list; AddHosts and RemoveHosts are applied after it.
+	Hosts       *[]string
+	AddHosts    []string
+	RemoveHosts []string
+	AuthorName  *string
+	DisplayName *string
+	// AliasTemplate sets the profile's own alias template; an empty string clears it.
+	AliasTemplate *string
+	// SetSSHOptions replaces every option with the same key, keeping its position;
+	// options with new keys are appended. UnsetSSHOptions removes options by key.
+	SetSSHOptions   []sshconfig.Option
+	UnsetSSHOptions []string
+	// Dirs replaces the directories using the profile's identity; AddDirs and RemoveDirs
+	// are applied after it.
+	Dirs       *[]string
+	AddDirs    []string
+	RemoveDirs []string
+}
+
+// Edit updates the metadata of an existing profile in place, keeping its key pair. A
+// change to the ssh options is also applied to the core.sshCommand gipo set in the
+// profile's repositories.
+// It returns the updated profile and its ssh aliases before and after the change.
+func Edit(baseDir, profileName string, edit ProfileEdit) (profile *Profile, oldAliases, newAliases []string, err error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer lock.Unlock()
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	profile, ok := meta[profileName]
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("profile '%s' not found", profileName)
+	}
+
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	oldAliases = profile.aliases(settings.AliasTemplate)
+
+	if edit.Email != nil {
+		if *edit.Email == "" {
+			return nil, nil, nil, fmt.Errorf("email cannot be empty")
+		}
+		profile.Email = *edit.Email
+	}
+	if edit.Hosts != nil {
+		profile.Hosts = slices.Clone(*edit.Hosts)
+	}
+	for _, h := range edit.AddHosts {
+		if !slices.Contains(profile.Hosts, h) {
+			profile.Hosts = append(profile.Hosts, h)
+		}
+	}
+	for _, h := range edit.RemoveHosts {
+		i := slices.Index(profile.Hosts, h)
+		if i == -1 {
+			return nil, nil, nil, fmt.Errorf("profile '%s' has no host '%s'", profileName, h)
+		}
+		profile.Hosts = slices.Delete(profile.Hosts, i, i+1)
+	}
+	if edit.AuthorName != nil {
+		profile.AuthorName = *edit.AuthorName
+	}
+	if edit.DisplayName != nil {
+		profile.DisplayName = *edit.DisplayName
+	}
+	oldOptions := slices.Clone(profile.SSHOptions)
+	profile.SSHOptions = setSSHOptions(profile.SSHOptions, edit.SetSSHOptions)
+	for _, k := range edit.UnsetSSHOptions {
+		n := len(profile.SSHOptions)
+		profile.SSHOptions = slices.DeleteFunc(profile.SSHOptions, func(o sshconfig.Option) bool { return strings.EqualFold(o.Key, k) })
+		if len(profile.SSHOptions) == n {
+			return nil, nil, nil, fmt.Errorf("profile '%s' has no ssh option '%s'", profileName, k)
+		}
+	}
+
+	if edit.Dirs != nil {
+		profile.Dirs = nil
+		edit.AddDirs = append(slices.Clone(*edit.Dirs), edit.AddDirs...)
+	}
+	for _, d := range edit.AddDirs {
+		dir, err := normalizeDir(d)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !slices.Contains(profile.Dirs, dir) {
+			profile.Dirs = append(profile.Dirs, dir)
+		}
+	}
+	for _, d := range edit.RemoveDirs {
+		dir, err := normalizeDir(d)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		i := slices.Index(profile.Dirs, dir)
+		if i == -1 {
+			return nil, nil, nil, fmt.Errorf("profile '%s' has no directory '%s'", profileName, dir)
+		}
+		profile.Dirs = slices.Delete(profile.Dirs, i, i+1)
+	}
+	if err := checkDirConflicts(meta); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if edit.AliasTemplate != nil {
+		if *edit.AliasTemplate != "" {
+			if err := validateAliasTemplate(*edit.AliasTemplate); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		profile.AliasTemplate = *edit.AliasTemplate
+	}
+
+	newAliases = profile.aliases(settings.AliasTemplate)
+
+	if err := SaveProfiles(baseDir, meta); err != nil {
+		return nil, nil, nil, err
+	}
+	if !slices.Equal(oldOptions, profile.SSHOptions) {
+		if err := refreshSSHCommands(profile); err != nil {
+			return profile, oldAliases, newAliases, fmt.Errorf("profile updated but core.sshCommand was not: %w", err)
+		}
+	}
+	return profile, oldAliases, newAliases, nil
+}
+
+// setSSHOptions returns opts with the options in set applied. All options sharing a key
+// with set are replaced by the new ones at the position of the first; new keys are appended.
+// Keys can repeat in set for directives ssh accepts several times (e.g. LocalForward).
+func setSSHOptions(opts, set []sshconfig.Option) []sshconfig.Option {
+	out := slices.Clone(opts)
+	done := make(map[string]bool)
+	for _, o := range set {
+		k := strings.ToLower(o.Key)
+		if done[k] {
+			continue
+		}
+		done[k] = true
+		var values []sshconfig.Option
+		for _, n := range set {
+			if strings.EqualFold(n.Key, k) {
+				values = append(values, n)
+			}
+		}
+		i := slices.IndexFunc(out, func(e sshconfig.Option) bool { return strings.EqualFold(e.Key, k) })
+		if i == -1 {
+			out = append(out, values...)
+			continue
+		}
+		out = slices.DeleteFunc(out, func(e sshconfig.Option) bool { return strings.EqualFold(e.Key, k) })
+		out = slices.Insert(out, i, values...)
+	}
+	return out
+}
+
+// aliasRenames pairs the aliases an edit replaced, oldAliases, with their replacements in
+// newAliases. planned are the renames sync plans (SSHPlan.Renames), which pair the aliases
+// of the same host, e.g. every alias after an alias template change. What is left is a
+// rename only if one host was swapped for a different one.
+func aliasRenames(oldAliases, newAliases []string, planned []AliasRename) []AliasRename {
+	var renames []AliasRename
+	for _, r := range planned {
+		if slices.Contains(oldAliases, r.From) && slices.Contains(newAliases, r.To) {
+			renames = append(renames, r)
+		}
+	}
+	var removed, added []string
+	for _, a := range oldAliases {
+		if !slices.Contains(newAliases, a) && !slices.ContainsFunc(renames, func(r AliasRename) bool { return r.From == a }) {
+			removed = append(removed, a)
+		}
+	}
+	for _, a := range newAliases {
+		if !slices.Contains(oldAliases, a) && !slices.ContainsFunc(renames, func(r AliasRename) bool { return r.To == a }) {
+			added = append(added, a)
+		}
+	}
+	if len(removed) == 1 && len(added) == 1 {
+		renames = append(renames, AliasRename{From: removed[0], To: added[0]})
+	}
+	return renames
+}
+
+// rewriteRemoteAlias replaces oldAlias with newAlias in every remote url and pushurl of
+// the repository at dir. It returns the config keys that were changed.
+func rewriteRemoteAlias(dir, oldAlias, newAlias string) ([]string, error) {
+	remotes, err := remoteURLs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for _, r := range remotes {
+		newURL := strings.Replace(r.URL, "@"+oldAlias+":", "@"+newAlias+":", 1)
+		newURL = strings.Replace(newURL, "@"+oldAlias+"/", "@"+newAlias+"/", 1)
+		if newURL == r.URL {
+			continue
+		}
+		if err := setRemoteURL(dir, r, newURL); err != nil {
+			return changed, err
+		}
+		changed = append(changed, r.Key)
+	}
+	return changed, nil
+}
+
+// remoteURL is one url or pushurl value of a remote.
+type remoteURL struct {
+	// Key is the config key, e.g. "remote.origin.pushurl".
+	Key string
+	URL string
+}
+
+// remoteURLs returns the url and pushurl values of all remotes of the repository at dir,
+// in config order. A remote may have several pushurls.
+func remoteURLs(dir string) ([]remoteURL, error) {
+	cmd := exec.Command("git", "config", "--local", "--get-regexp", `^remote\..*\.(url|pushurl)$`)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		// exit code 1 means no remotes are configured
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && ee.ExitCode() == 1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read remotes in %s: %w", dir, err)
+	}
+
+	var remotes []remoteURL
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		k, url, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+		remotes = append(remotes, remoteURL{Key: k, URL: url})
+	}
+	return remotes, nil
+}
+
+// setRemoteURL replaces the value r with url, leaving other values of the same key alone.
+func setRemoteURL(dir string, r remoteURL, url string) error {
+	set := exec.Command("git", "config", "--local", "--replace-all", r.Key, url, "^"+regexp.QuoteMeta(r.URL)+"$")
+	set.Dir = dir
+	if err := set.Run(); err != nil {
+		return fmt.Errorf("failed to set %s in %s: %w", r.Key, dir, err)
+	}
+	return nil
+}
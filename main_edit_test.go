@@ -0,0 +1,199 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/snowmerak/gipo/key"
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+func TestEdit(t *testing.T) {
+	d := t.TempDir()
+	if err := Init(d); err != nil {
+		t.Fatal(err)
+	}
+	priv, _, err := Add(d, "ed25519", Profile{Name: "alice", Email: "alice@example.com", Hosts: []string{"github.com"}}, key.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.ReadFile(priv)
+
+	email := "alice@company.com"
+	hosts := []string{"gitlab.com"}
+	p, oldAliases, newAliases, err := Edit(d, "alice", ProfileEdit{Email: &email, Hosts: &hosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := aliasRenames(oldAliases, newAliases, nil); !slices.Equal(got, []AliasRename{{From: "git-alice-github-com", To: "git-alice-gitlab-com"}}) {
+		t.Fatalf("unexpected renames for %v -> %v: %v", oldAliases, newAliases, got)
+	}
+	if p.Email != email || !slices.Equal(p.Hosts, hosts) {
+		t.Fatalf("profile not updated: %#v", p)
+	}
+
+	meta, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["alice"].Email != email || !slices.Equal(meta["alice"].Hosts, hosts) || meta["alice"].Private != priv {
+		t.Fatalf("saved profile mismatch: %#v", meta["alice"])
+	}
+	after, _ := os.ReadFile(priv)
+	if string(before) != string(after) {
+		t.Fatalf("private key changed by edit")
+	}
+
+	author := "Alice Liddell"
+	if p, _, _, err = Edit(d, "alice", ProfileEdit{AuthorName: &author}); err != nil {
+		t.Fatal(err)
+	}
+	if p.AuthorName != author || p.Email != "alice@company.com" {
+		t.Fatalf("author not updated or other fields changed: %#v", p)
+	}
+
+	// email only: aliases unchanged
+	email = "alice@example.org"
+	if _, oldAliases, newAliases, err = Edit(d, "alice", ProfileEdit{Email: &email}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(oldAliases, newAliases) {
+		t.Fatalf("aliases should not change: %v -> %v", oldAliases, newAliases)
+	}
+
+	// adding a host adds an alias but renames nothing
+	if p, oldAliases, newAliases, err = Edit(d, "alice", ProfileEdit{AddHosts: []string{"github.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(p.Hosts, []string{"gitlab.com", "github.com"}) {
+		t.Fatalf("host not added: %v", p.Hosts)
+	}
+	if got := aliasRenames(oldAliases, newAliases, nil); len(got) != 0 {
+		t.Fatalf("adding a host is not a rename: %v -> %v: %v", oldAliases, newAliases, got)
+	}
+	if _, _, _, err := Edit(d, "alice", ProfileEdit{RemoveHosts: []string{"bitbucket.org"}}); err == nil {
+		t.Fatal("expected error removing unknown host")
+	}
+
+	if _, _, _, err := Edit(d, "nobody", ProfileEdit{Email: &email}); err == nil {
+		t.Fatal("expected error for unknown profile")
+	}
+}
+
+func TestEditAliasTemplateRenames(t *testing.T) {
+	d, cfg := newSyncedStore(t, Profile{Name: "work", Email: "me@company.com", Hosts: []string{"github.com", "gitlab.com"}})
+	tmpl := "{host_short}-{profile}"
+	_, oldAliases, newAliases, err := Edit(d, "work", ProfileEdit{AliasTemplate: &tmpl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanSSHConfig(d, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every host's alias is renamed, not just one
+	want := []AliasRename{
+		{From: "git-work-github-com", To: "github-work"},
+		{From: "git-work-gitlab-com", To: "gitlab-work"},
+	}
+	got := aliasRenames(oldAliases, newAliases, plan.Renames)
+	slices.SortFunc(got, func(a, b AliasRename) int { return strings.Compare(a.From, b.From) })
+	if !slices.Equal(got, want) {
+		t.Fatalf("renames = %v, want %v", got, want)
+	}
+}
+
+func TestRewriteRemoteAlias(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	d := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = d
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("remote", "add", "origin", "git@git-alice-github-com:alice/repo.git")
+	git("config", "--add", "remote.origin.pushurl", "git@git-alice-github-com:alice/repo.git")
+	git("config", "--add", "remote.origin.pushurl", "git@example.com:mirror/repo.git")
+	git("remote", "add", "other", "https://example.com/other.git")
+
+	changed, err := rewriteRemoteAlias(d, "git-alice-github-com", "git-alice-gitlab-com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 2 {
+		t.Fatalf("expected 2 changed keys, got %v", changed)
+	}
+	if got := git("config", "remote.origin.url"); got != "git@git-alice-gitlab-com:alice/repo.git" {
+		t.Fatalf("origin url not rewritten: %s", got)
+	}
+	if got := git("config", "--get-all", "remote.origin.pushurl"); got != "git@git-alice-gitlab-com:alice/repo.git\ngit@example.com:mirror/repo.git" {
+		t.Fatalf("pushurls not rewritten: %s", got)
+	}
+	if got := git("config", "remote.other.url"); got != "https://example.com/other.git" {
+		t.Fatalf("unrelated remote changed: %s", got)
+	}
+}
+
+func TestSetSSHOptions(t *testing.T) {
+	opts := []sshconfig.Option{
+		{Key: "Port", Value: "2222"},
+		{Key: "LocalForward", Value: "1 a:1"},
+		{Key: "LocalForward", Value: "2 a:2"},
+		{Key: "ServerAliveInterval", Value: "30"},
+	}
+	got := setSSHOptions(opts, []sshconfig.Option{
+		{Key: "localforward", Value: "3 a:3"},
+		{Key: "ProxyJump", Value: "bastion"},
+		{Key: "port", Value: "22"},
+	})
+	want := []sshconfig.Option{
+		{Key: "port", Value: "22"},
+		{Key: "localforward", Value: "3 a:3"},
+		{Key: "ServerAliveInterval", Value: "30"},
+		{Key: "ProxyJump", Value: "bastion"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("setSSHOptions = %#v, want %#v", got, want)
+	}
+}
+
+func TestEditSSHOptionsDrift(t *testing.T) {
+	d, cfg := newSyncedStore(t, Profile{Name: "work", Email: "me@company.com", Hosts: []string{"gitlab.example.com"}})
+
+	if _, _, _, err := Edit(d, "work", ProfileEdit{SetSSHOptions: []sshconfig.Option{{Key: "Port", Value: "2222"}}}); err != nil {
+		t.Fatal(err)
+	}
+	adds, _, err := PreviewSSHConfig(d, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adds) != 1 || len(adds[0].Options) != 1 || adds[0].Options[0].Value != "2222" {
+		t.Fatalf("expected option change to be pending, got %#v", adds)
+	}
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if adds, _, _ := PreviewSSHConfig(d, cfg, true); len(adds) != 0 {
+		t.Fatalf("expected no changes after sync, got %#v", adds)
+	}
+
+	if _, _, _, err := Edit(d, "work", ProfileEdit{UnsetSSHOptions: []string{"port"}}); err != nil {
+		t.Fatal(err)
+	}
+	if adds, _, _ := PreviewSSHConfig(d, cfg, true); len(adds) != 1 {
+		t.Fatalf("expected option removal to be pending, got %#v", adds)
+	}
+	if _, _, _, err := Edit(d, "work", ProfileEdit{UnsetSSHOptions: []string{"Port"}}); err == nil {
+		t.Fatal("expected error unsetting a missing option")
+	}
+}
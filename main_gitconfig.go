@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/snowmerak/gipo/fsutil"
+)
+
+// gitIncludeMarker starts the markers around the includeIf sections gipo writes into the
+// global git config; the store owner follows it, so several stores can share the file.
+const gitIncludeMarker = "GITPROFILES includeIf"
+
+// DirInclude is an includeIf section giving the repositories under Dir the identity of
+// a profile.
+type DirInclude struct {
+	// Dir is the directory as written after "gitdir:", ending in a slash.
+	Dir     string `json:"dir"`
+	Profile string `json:"profile"`
+	// Fragment is the git config file included for Dir.
+	Fragment string `json:"fragment"`
+}
+
+// GitConfigPlan describes the changes sync makes for directory identities: the git config
+// fragment of every profile with directories, in <base>/gitconfig, and the includeIf
+// sections gipo manages in the global git config.
+type GitConfigPlan struct {
+	// Path is the global git config file.
+	Path string `json:"path"`
+	// Adds and Removes are the includeIf sections sync adds to and removes from Path.
+	Adds    []DirInclude `json:"adds,omitempty"`
+	Removes []DirInclude `json:"removes,omitempty"`
+	// Changes are the files sync writes, Path last. An empty After deletes a fragment
+	// that no profile uses anymore.
+	Changes []ConfigChange `json:"-"`
+}
+
+// Empty reports whether the plan has nothing to do.
+func (p *GitConfigPlan) Empty() bool {
+	return p == nil || len(p.Changes) == 0
+}
+
+// PlanGitConfig compares the directories of the profiles with the fragments in baseDir and
+// the includeIf sections in the git config at gitCfgPath (default ~/.gitconfig), without
+// changing anything. Sections are ordered by directory depth, so a profile mapped to
+// ~/work/oss wins over one mapped to ~/work for the repositories under ~/work/oss.
+func PlanGitConfig(baseDir, gitCfgPath string) (*GitConfigPlan, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if gitCfgPath == "" {
+		home, _ := os.UserHomeDir()
+		gitCfgPath = filepath.Join(home, ".gitconfig")
+	}
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	if err := checkDirConflicts(meta); err != nil {
+		return nil, err
+	}
+
+	plan := &GitConfigPlan{Path: gitCfgPath}
+	var want []DirInclude
+	fragments := map[string]bool{}
+	for _, name := range slices.Sorted(maps.Keys(meta)) {
+		p := meta[name]
+		if len(p.Dirs) == 0 {
+			continue
+		}
+		fragment := gitFragmentPath(baseDir, name)
+		fragments[fragment] = true
+		before, err := readConfig(fragment)
+		if err != nil {
+			return nil, err
+		}
+		if after := renderGitFragment(p); after != before {
+			plan.Changes = append(plan.Changes, ConfigChange{Path: fragment, Before: before, After: after})
+		}
+		for _, d := range p.Dirs {
+			want = append(want, DirInclude{Dir: d, Profile: name, Fragment: fragment})
+		}
+	}
+	slices.SortStableFunc(want, func(a, b DirInclude) int {
+		if n := strings.Count(a.Dir, "/") - strings.Count(b.Dir, "/"); n != 0 {
+			return n
+		}
+		return strings.Compare(a.Dir, b.Dir)
+	})
+
+	// fragments of profiles that lost their directories or were removed
+	stale, _ := filepath.Glob(filepath.Join(baseDir, "gitconfig", "*.gitconfig"))
+	for _, f := range stale {
+		if fragments[f] {
+			continue
+		}
+		before, err := readConfig(f)
+		if err != nil {
+			return nil, err
+		}
+		plan.Changes = append(plan.Changes, ConfigChange{Path: f, Before: before})
+	}
+
+	content, err := readConfig(gitCfgPath)
+	if err != nil {
+		return nil, err
+	}
+	owner := storeOwner(baseDir)
+	have := parseGitIncludes(content, owner)
+	for _, w := range want {
+		if !slices.Contains(have, w) {
+			plan.Adds = append(plan.Adds, w)
+		}
+	}
+	for _, h := range have {
+		if !slices.Contains(want, h) {
+			plan.Removes = append(plan.Removes, h)
+		}
+	}
+	if after := setGitIncludes(content, owner, want); after != content {
+		plan.Changes = append(plan.Changes, ConfigChange{Path: gitCfgPath, Before: content, After: after})
+	}
+	return plan, nil
+}
+
+// SyncGitConfig applies the changes calculated by PlanGitConfig. Fragments are written
+// before the git config including them. The global git config is not locked with a
+// sidecar file like the ssh config, because "<file>.lock" is git's own lock; gipo's
+// writers are serialized by the profiles lock instead.
+func SyncGitConfig(baseDir, gitCfgPath string) error {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	plan, err := PlanGitConfig(baseDir, gitCfgPath)
+	if err != nil {
+		return err
+	}
+	for _, c := range plan.Changes {
+		if c.After == "" {
+			if err := os.Remove(c.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		perm := os.FileMode(0o600)
+		if c.Path == plan.Path {
+			perm = 0o644
+		}
+		if err := os.MkdirAll(filepath.Dir(c.Path), 0o700); err != nil {
+			return err
+		}
+		if err := fsutil.WriteFile(c.Path, []byte(c.After), perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gitFragmentPath returns the git config fragment of a profile.
+func gitFragmentPath(baseDir, profileName string) string {
+	return filepath.Join(baseDir, "gitconfig", profileName+".gitconfig")
+}
+
+// renderGitFragment returns the git config fragment setting the identity of p.
+func renderGitFragment(p *Profile) string {
+	name, _ := p.gitUserName()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Written by gipo for profile '%s'; 'gipo sync' overwrites changes.\n", p.Name)
+	sb.WriteString("[user]\n")
+	fmt.Fprintf(&sb, "\tname = %s\n", gitQuote(name))
+	fmt.Fprintf(&sb, "\temail = %s\n", gitQuote(p.Email))
+	return sb.String()
+}
+
+// gitIncludeMarkers returns the BEGIN and END lines around the includeIf sections of
+// the store owner.
+func gitIncludeMarkers(owner string) (begin, end string) {
+	return "# BEGIN " + gitIncludeMarker + " owner=" + owner, "# END " + gitIncludeMarker + " owner=" + owner
+}
+
+// gitIncludeBlock returns the line range [start, end] of the owner's managed block in
+// lines, or ok == false if there is none. A block that lost its END line ends with the
+// last includeIf section following BEGIN, so the user's own settings are never taken.
+func gitIncludeBlock(lines []string, owner string) (start, end int, ok bool) {
+	begin, stop := gitIncludeMarkers(owner)
+	start = slices.IndexFunc(lines, func(l string) bool { return strings.TrimSpace(l) == begin })
+	if start == -1 {
+		return 0, 0, false
+	}
+	end = start
+	for i := start + 1; i < len(lines); i++ {
+		l := strings.TrimSpace(lines[i])
+		if l == stop {
+			return start, i, true
+		}
+		if !strings.HasPrefix(l, `[includeIf "gitdir:`) && !strings.HasPrefix(l, "path") {
+			break
+		}
+		end = i
+	}
+	return start, end, true
+}
+
+// parseGitIncludes returns the includeIf sections in the owner's managed block of content.
+func parseGitIncludes(content, owner string) []DirInclude {
+	lines := strings.Split(content, "\n")
+	start, end, ok := gitIncludeBlock(lines, owner)
+	if !ok {
+		return nil
+	}
+	var out []DirInclude
+	for _, l := range lines[start+1 : end+1] {
+		l = strings.TrimSpace(l)
+		if dir, ok := strings.CutPrefix(l, `[includeIf "gitdir:`); ok {
+			out = append(out, DirInclude{Dir: gitUnquote(strings.TrimSuffix(dir, `"]`))})
+			continue
+		}
+		if key, value, ok := strings.Cut(l, "="); ok && strings.TrimSpace(key) == "path" && len(out) > 0 {
+			f := filepath.FromSlash(gitUnquote(strings.TrimSpace(value)))
+			out[len(out)-1].Fragment = f
+			out[len(out)-1].Profile = strings.TrimSuffix(filepath.Base(f), ".gitconfig")
+		}
+	}
+	return out
+}
+
+// setGitIncludes replaces the owner's managed block of content with includes. The block
+// is appended at the end, after the user's own settings, so that it overrides them; with
+// no includes it is removed.
+func setGitIncludes(content, owner string, includes []DirInclude) string {
+	var block []string
+	if len(includes) > 0 {
+		begin, end := gitIncludeMarkers(owner)
+		block = append(block, begin)
+		for _, in := range includes {
+			block = append(block, `[includeIf "gitdir:`+gitEscape(in.Dir)+`"]`)
+			block = append(block, "\tpath = "+gitQuote(filepath.ToSlash(in.Fragment)))
+		}
+		block = append(block, end)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+	if start, end, ok := gitIncludeBlock(lines, owner); ok {
+		lines = slices.Replace(lines, start, end+1, block...)
+		// drop the blank line that separated a removed block
+		if len(block) == 0 && start > 0 && start == len(lines) && strings.TrimSpace(lines[start-1]) == "" {
+			lines = lines[:start-1]
+		}
+	} else if len(block) == 0 {
+		// nothing to add or remove; keep the file byte for byte
+		return content
+	} else {
+		if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) != "" {
+			lines = append(lines, "")
+		}
+		lines = append(lines, block...)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// gitQuote returns s as a double-quoted git config value.
+func gitQuote(s string) string {
+	return `"` + gitEscape(s) + `"`
+}
+
+// gitEscape escapes backslashes and double quotes for a git config value or subsection.
+func gitEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// gitUnquote reverses gitQuote and gitEscape.
+func gitUnquote(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		s = s[1 : len(s)-1]
+	}
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(s)
+}
+
+// normalizeDir returns dir in the form used after "gitdir:": "~/" is kept so the mapping
+// follows the home directory, other relative paths are made absolute, and a trailing slash
+// makes git match every repository below the directory.
+func normalizeDir(dir string) (string, error) {
+	if strings.TrimSpace(dir) == "" {
+		return "", fmt.Errorf("directory cannot be empty")
+	}
+	if dir != "~" && !strings.HasPrefix(dir, "~/") {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return "", err
+		}
+		dir = abs
+	}
+	dir = path.Clean(filepath.ToSlash(dir))
+	if !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	return dir, nil
+}
+
+// checkDirConflicts returns an error if a directory is mapped to more than one profile.
+func checkDirConflicts(meta map[string]*Profile) error {
+	owners := map[string]string{}
+	for _, name := range slices.Sorted(maps.Keys(meta)) {
+		for _, d := range meta[name].Dirs {
+			if other, ok := owners[d]; ok && other != name {
+				return fmt.Errorf("directory %s is mapped to profiles '%s' and '%s'", d, other, name)
+			}
+			owners[d] = name
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeDir(t *testing.T) {
+	abs, _ := filepath.Abs("rel")
+	tests := map[string]string{
+		"~/work":         "~/work/",
+		"~/work/../src/": "~/src/",
+		"~":              "~/",
+		"rel":            filepath.ToSlash(abs) + "/",
+	}
+	for in, want := range tests {
+		if got, err := normalizeDir(in); err != nil || got != want {
+			t.Errorf("normalizeDir(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := normalizeDir(" "); err == nil {
+		t.Error("expected an error for an empty directory")
+	}
+}
+
+func TestSyncGitConfig(t *testing.T) {
+	d, _ := newStore(t,
+		Profile{Name: "work", Email: "me@company.com", AuthorName: "Me", Hosts: []string{"github.com"}},
+		Profile{Name: "personal", Email: "me@home.org", Hosts: []string{"github.com"}})
+	src := t.TempDir()
+	work := filepath.Join(src, "work")
+	oss := filepath.Join(work, "oss")
+	if _, _, _, err := Edit(d, "work", ProfileEdit{AddDirs: []string{work}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := Edit(d, "personal", ProfileEdit{AddDirs: []string{oss}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := Edit(d, "personal", ProfileEdit{AddDirs: []string{work}}); err == nil {
+		t.Fatal("expected an error for a directory mapped to two profiles")
+	}
+
+	gitCfg := filepath.Join(d, "gitconfig-global")
+	original := "[user]\n\tname = Default\n\temail = default@example.com\n"
+	os.WriteFile(gitCfg, []byte(original), 0o644)
+
+	plan, err := PlanGitConfig(d, gitCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Adds) != 2 || len(plan.Changes) != 3 || plan.Changes[2].Path != gitCfg {
+		t.Fatalf("unexpected plan: %#v", plan)
+	}
+	// the deeper directory comes last so that it wins
+	if plan.Adds[0].Profile != "work" || plan.Adds[1].Profile != "personal" {
+		t.Fatalf("includes in wrong order: %#v", plan.Adds)
+	}
+	if err := SyncGitConfig(d, gitCfg); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(gitCfg)
+	if !strings.HasPrefix(string(b), original+"\n# BEGIN GITPROFILES includeIf owner=") {
+		t.Fatalf("user settings not kept first:\n%s", b)
+	}
+	if plan, err := PlanGitConfig(d, gitCfg); err != nil || !plan.Empty() {
+		t.Fatalf("expected nothing left to sync, got %#v (%v)", plan, err)
+	}
+
+	if _, err := exec.LookPath("git"); err == nil {
+		for dir, want := range map[string]string{work: "me@company.com", oss: "me@home.org", src: "default@example.com"} {
+			repo := filepath.Join(dir, "repo")
+			if out, err := exec.Command("git", "init", "-q", repo).CombinedOutput(); err != nil {
+				t.Fatalf("git init: %v: %s", err, out)
+			}
+			cmd := exec.Command("git", "config", "user.email")
+			cmd.Dir = repo
+			cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL="+gitCfg, "GIT_CONFIG_NOSYSTEM=1")
+			out, err := cmd.Output()
+			if err != nil || strings.TrimSpace(string(out)) != want {
+				t.Errorf("user.email in %s = %q (%v), want %s", dir, out, err, want)
+			}
+		}
+	}
+
+	// an email change rewrites only the fragment
+	email := "me@corp.example"
+	if _, _, _, err := Edit(d, "work", ProfileEdit{Email: &email}); err != nil {
+		t.Fatal(err)
+	}
+	if plan, _ := PlanGitConfig(d, gitCfg); len(plan.Changes) != 1 || plan.Changes[0].Path != gitFragmentPath(d, "work") {
+		t.Fatalf("expected only the work fragment to change, got %#v", plan)
+	}
+
+	// dropping every directory removes the fragments and restores the file
+	if _, _, _, err := Edit(d, "work", ProfileEdit{Dirs: &[]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := Edit(d, "personal", ProfileEdit{RemoveDirs: []string{oss}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncGitConfig(d, gitCfg); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(gitCfg); string(b) != original {
+		t.Fatalf("git config not restored:\n%s", b)
+	}
+	if fragments, _ := filepath.Glob(filepath.Join(d, "gitconfig", "*")); len(fragments) != 0 {
+		t.Fatalf("stale fragments left: %v", fragments)
+	}
+}
+
+func TestSetGitIncludesMissingEnd(t *testing.T) {
+	begin, _ := gitIncludeMarkers("abcd")
+	content := "[core]\n\teditor = vim\n" + begin + "\n[includeIf \"gitdir:~/a/\"]\n\tpath = \"/x/a.gitconfig\"\n[alias]\n\tst = status\n"
+	got := setGitIncludes(content, "abcd", nil)
+	if got != "[core]\n\teditor = vim\n[alias]\n\tst = status\n" {
+		t.Fatalf("user settings lost:\n%s", got)
+	}
+}
+
+func TestPlanGitConfigNoTrailingNewline(t *testing.T) {
+	d, _ := newStore(t)
+	gitCfg := filepath.Join(t.TempDir(), ".gitconfig")
+	original := "[user]\n\tname = Me"
+	os.WriteFile(gitCfg, []byte(original), 0o644)
+
+	plan, err := PlanGitConfig(d, gitCfg)
+	if err != nil || !plan.Empty() {
+		t.Fatalf("expected nothing to do, got %#v (%v)", plan, err)
+	}
+	if err := SyncGitConfig(d, gitCfg); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(gitCfg); string(b) != original {
+		t.Fatalf("git config rewritten:\n%q", b)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/snowmerak/gipo/fsutil"
+	"github.com/snowmerak/gipo/key"
+	"golang.org/x/crypto/ssh"
+)
+
+// Import records an existing private key as profile p. The algorithm is detected from the key.
+// By default the key pair is copied into <baseDir>/keys; with reference the profile points at
+// keyPath in place. If <keyPath>.pub is missing the public key is derived from the private key.
+// passphrase is called only when the key is encrypted.
+func Import(baseDir, keyPath string, p Profile, reference bool, passphrase func() ([]byte, error)) (privatePath, publicPath string, err error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	if keyPath == "" || p.Name == "" || p.Email == "" {
+		return "", "", errors.New("private key, name and email are required")
+	}
+	if p.AliasTemplate != "" {
+		if err := validateAliasTemplate(p.AliasTemplate); err != nil {
+			return "", "", err
+		}
+	}
+	keyPath, err = filepath.Abs(keyPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	privBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return "", "", err
+	}
+	sshPub, err := key.ParsePrivateKey(privBytes, nil)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == nil {
+			return "", "", fmt.Errorf("%s is passphrase protected", keyPath)
+		}
+		pass, perr := passphrase()
+		if perr != nil {
+			return "", "", perr
+		}
+		sshPub, err = key.ParsePrivateKey(privBytes, pass)
+		p.Encrypted = true
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse private key: %w", err)
+	}
+	algo, err := key.Algorithm(sshPub)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Keep an existing .pub file (and its comment) if it matches; otherwise derive one.
+	pubBytes, err := os.ReadFile(keyPath + ".pub")
+	if err == nil {
+		filePub, _, _, _, perr := ssh.ParseAuthorizedKey(pubBytes)
+		if perr != nil {
+			return "", "", fmt.Errorf("failed to parse %s.pub: %w", keyPath, perr)
+		}
+		if string(filePub.Marshal()) != string(sshPub.Marshal()) {
+			return "", "", fmt.Errorf("%s.pub does not match the private key", keyPath)
+		}
+	} else if os.IsNotExist(err) {
+		line := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(sshPub)), "\n")
+		pubBytes = []byte(fmt.Sprintf("%s %s@%s", line, p.Name, p.Email))
+	} else {
+		return "", "", err
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return "", "", err
+	}
+	defer lock.Unlock()
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+		meta = make(map[string]*Profile)
+	}
+	if _, exists := meta[p.Name]; exists {
+		return "", "", fmt.Errorf("profile '%s' already exists", p.Name)
+	}
+
+	if reference {
+		privatePath, publicPath = keyPath, keyPath+".pub"
+		if _, err := os.Stat(publicPath); os.IsNotExist(err) {
+			if err := fsutil.WriteFile(publicPath, pubBytes, 0o644); err != nil {
+				return "", "", err
+			}
+		}
+	} else {
+		privatePath, publicPath = keyFilePaths(baseDir, p.Name, algo)
+		if err := writeKeyPair(privatePath, publicPath, string(privBytes), string(pubBytes)); err != nil {
+			return "", "", err
+		}
+	}
+
+	p.Algo = algo
+	p.Private = privatePath
+	p.Public = publicPath
+	p.KeyRef = reference
+	p.Created = time.Now().UTC()
+	meta[p.Name] = &p
+
+	if err := SaveProfiles(baseDir, meta); err != nil {
+		return privatePath, publicPath, err
+	}
+	return privatePath, publicPath, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snowmerak/gipo/key"
+)
+
+func TestImport(t *testing.T) {
+	d := t.TempDir()
+	if err := Init(d); err != nil {
+		t.Fatal(err)
+	}
+
+	gen, _ := key.GetKeyGenerator(key.P384)
+	priv, _, err := gen.Generate("old", "example.com", key.Options{Format: key.FormatPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(d, "id_existing")
+	if err := os.WriteFile(src, []byte(priv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// copy mode, no .pub next to the key: public key is derived
+	privPath, pubPath, err := Import(d, src, Profile{Name: "work", Email: "me@company.com", Hosts: []string{"github.com"}}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privPath != filepath.Join(d, "keys", "work_id_p384") {
+		t.Fatalf("unexpected private path: %s", privPath)
+	}
+	pub, err := os.ReadFile(pubPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(pub), "ecdsa-sha2-nistp384 ") {
+		t.Fatalf("unexpected public key: %s", pub)
+	}
+	meta, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := meta["work"]; p.Algo != key.P384 || p.Private != privPath || p.KeyRef {
+		t.Fatalf("unexpected profile: %#v", p)
+	}
+
+	if _, _, err := Import(d, src, Profile{Name: "work", Email: "me@company.com"}, false, nil); err == nil {
+		t.Fatal("expected error importing over an existing profile")
+	}
+
+	// reference mode keeps the key in place
+	privPath, pubPath, err = Import(d, src, Profile{Name: "ref", Email: "me@company.com"}, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if privPath != src || pubPath != src+".pub" {
+		t.Fatalf("reference import should use the key in place: %s %s", privPath, pubPath)
+	}
+	meta, err = LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := meta["ref"]; p.Private != src || !p.KeyRef {
+		t.Fatalf("referenced path not preserved: %#v", p)
+	}
+
+	// removing a referenced profile leaves the user's key alone
+	if err := Remove(d, filepath.Join(d, "config"), "ref", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Fatalf("referenced key should be kept: %v", err)
+	}
+}
+
+func TestImportEncrypted(t *testing.T) {
+	d := t.TempDir()
+	if err := Init(d); err != nil {
+		t.Fatal(err)
+	}
+	gen, _ := key.GetKeyGenerator(key.ED25519)
+	priv, _, err := gen.Generate("old", "example.com", key.Options{Passphrase: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(d, "id_encrypted")
+	if err := os.WriteFile(src, []byte(priv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Import(d, src, Profile{Name: "work", Email: "me@company.com"}, false, nil); err == nil {
+		t.Fatal("expected error without a passphrase prompt")
+	}
+
+	asked := 0
+	ask := func() ([]byte, error) {
+		asked++
+		return []byte("secret"), nil
+	}
+	if _, _, err := Import(d, src, Profile{Name: "work", Email: "me@company.com"}, false, ask); err != nil {
+		t.Fatal(err)
+	}
+	if asked != 1 {
+		t.Fatalf("expected one passphrase prompt, got %d", asked)
+	}
+	meta, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := meta["work"]; p.Algo != key.ED25519 || !p.Encrypted {
+		t.Fatalf("unexpected profile: %#v", p)
+	}
+}
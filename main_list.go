@@ -46,7 +46,7 @@ func ListProfiles(baseDir string) error {
 
 	// Use tabwriter for aligned output
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
-	fmt.Fprintln(w, "NAME\tEMAIL\tHOST\tALGO")
+	fmt.Fprintln(w, "NAME\tAUTHOR\tEMAIL\tHOSTS\tALGO\tENCRYPTED")
 
 	// Sort by name
 	var names []string
@@ -56,8 +56,20 @@ func ListProfiles(baseDir string) error {
 	sort.Strings(names)
 
 	for _, name := range names {
-		info := meta[name]
-		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, info["email"], info["host"], info["algo"])
+		p := meta[name]
+		label := name
+		if p.DisplayName != "" {
+			label = fmt.Sprintf("%s (%s)", name, p.DisplayName)
+		}
+		author, fallback := p.gitUserName()
+		if fallback {
+			author += " (profile name)"
+		}
+		encrypted := "no"
+		if p.Encrypted {
+			encrypted = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", label, author, p.Email, strings.Join(p.Hosts, ","), p.Algo, encrypted)
 	}
 	w.Flush()
 
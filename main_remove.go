@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+// Remove deletes a profile: its keys.json entry, its key pair and its managed ssh config block.
+// The key pair is archived under <baseDir>/backups/keys unless shred is true, in which case
+// the files are overwritten with random data before being deleted.
+// If a recorded repository still uses the profile's alias or the core.sshCommand gipo set
+// for it, Remove refuses unless force is true.
+func Remove(baseDir, cfgPath, profileName string, shred, force bool) error {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if cfgPath == "" {
+		home, _ := os.UserHomeDir()
+		cfgPath = filepath.Join(home, ".ssh", "config")
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return fmt.Errorf("failed to read profiles: %w", err)
+	}
+	profile, ok := meta[profileName]
+	if !ok {
+		return fmt.Errorf("profile '%s' not found", profileName)
+	}
+
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return err
+	}
+	aliases := profile.aliases(settings.AliasTemplate)
+
+	if inUse := reposUsingProfile(profile, aliases...); len(inUse) > 0 {
+		if !force {
+			return fmt.Errorf("profile '%s' is still used by: %s (use --force to remove anyway)", profileName, strings.Join(inUse, ", "))
+		}
+		fmt.Fprintf(os.Stderr, "warning: profile '%s' is still used by: %s\n", profileName, strings.Join(inUse, ", "))
+	}
+
+	// Remove the ssh config blocks first: a dangling alias pointing at a deleted key is worse
+	// than a leftover key file.
+	cfgFiles, err := sshConfigFiles(baseDir, cfgPath)
+	if err != nil {
+		return err
+	}
+	owner := storeOwner(baseDir)
+	for _, f := range cfgFiles {
+		existing, err := sshconfig.ListEntries(f)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to remove ssh config entry: %w", err)
+		}
+		for _, e := range existing {
+			// an alias of the same name in another store's block isn't ours to remove
+			if !slices.Contains(aliases, e.Alias) || !ownedBy(e, owner, aliases) {
+				continue
+			}
+			if err := sshconfig.RemoveEntry(f, e.Alias); err != nil {
+				return fmt.Errorf("failed to remove ssh config entry: %w", err)
+			}
+		}
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	// Referenced keys belong to the user; only the profile's own copies are archived or shredded.
+	var files []string
+	if !profile.KeyRef {
+		files = append(files, profile.Private, profile.Public)
+	}
+	for _, k := range profile.PreviousKeys {
+		if !k.KeyRef {
+			files = append(files, k.Private, k.Public)
+		}
+	}
+	for _, f := range files {
+		if f == "" {
+			continue
+		}
+		if shred {
+			err = shredFile(f)
+		} else {
+			_, err = archiveKeyFile(baseDir, f, stamp)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	delete(meta, profileName)
+	return SaveProfiles(baseDir, meta)
+}
+
+// reposUsingProfile returns the recorded repositories of p that still reach their remotes
+// through p: a remote points at one of aliases, or the repository has the core.sshCommand
+// gipo set for p, which names p's key files.
+func reposUsingProfile(p *Profile, aliases ...string) []string {
+	out := reposUsingAlias(p, aliases...)
+	for _, dir := range p.Repos {
+		if slices.Contains(out, dir) {
+			continue
+		}
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if localConfig(dir, sshCommandProfileKey) == p.Name {
+			out = append(out, dir)
+		}
+	}
+	return out
+}
+
+// profileRepos returns the repositories that would keep using profileName after it is
+// removed, as reposUsingProfile reports them.
+func profileRepos(baseDir, profileName string) ([]string, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	profile, ok := meta[profileName]
+	if !ok {
+		return nil, fmt.Errorf("profile '%s' not found", profileName)
+	}
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	return reposUsingProfile(profile, profile.aliases(settings.AliasTemplate)...), nil
+}
+
+// reposUsingAlias returns the recorded repositories of p that still have a remote
+// pointing at one of aliases. Repositories that no longer exist are ignored.
+func reposUsingAlias(p *Profile, aliases ...string) []string {
+	var out []string
+	for _, dir := range p.Repos {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		cmd := exec.Command("git", "remote", "-v")
+		cmd.Dir = dir
+		b, err := cmd.Output()
+		if err != nil {
+			continue
+		}
+		for _, alias := range aliases {
+			if s := string(b); strings.Contains(s, "@"+alias+":") || strings.Contains(s, "@"+alias+"/") {
+				out = append(out, dir)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// archiveKeyFile moves a key file into <baseDir>/backups/keys, suffixed with stamp.
+// It returns the archived path.
+func archiveKeyFile(baseDir, path, stamp string) (string, error) {
+	archiveDir := filepath.Join(baseDir, "backups", "keys")
+	if err := os.MkdirAll(archiveDir, 0o700); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(archiveDir, fmt.Sprintf("%s.%s", filepath.Base(path), stamp))
+	if err := os.Rename(path, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// shredFile overwrites path with random bytes, flushes it to disk and deletes it.
+func shredFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, info.Size())
+	if _, err := rand.Read(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/snowmerak/gipo/key"
+)
+
+func TestRemove(t *testing.T) {
+	d := t.TempDir()
+	if err := Init(d); err != nil {
+		t.Fatal(err)
+	}
+	priv, pub, err := Add(d, "ed25519", Profile{Name: "alice", Email: "alice@example.com", Hosts: []string{"github.com"}}, key.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Add(d, "ed25519", Profile{Name: "bob", Email: "bob@example.com", Hosts: []string{"github.com"}}, key.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := filepath.Join(d, "config")
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Remove(d, cfg, "alice", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := meta["alice"]; ok {
+		t.Fatalf("alice still present in meta")
+	}
+	if _, ok := meta["bob"]; !ok {
+		t.Fatalf("bob should be kept")
+	}
+
+	for _, f := range []string{priv, pub} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Fatalf("key file %s should have been moved, stat err: %v", f, err)
+		}
+	}
+	archived, _ := filepath.Glob(filepath.Join(d, "backups", "keys", "alice_id_ed25519*"))
+	if len(archived) != 2 {
+		t.Fatalf("expected 2 archived key files, got %v", archived)
+	}
+
+	b, _ := os.ReadFile(cfg)
+	if stringsContains(string(b), "git-alice-github-com") {
+		t.Fatalf("alice alias still in ssh config: %s", b)
+	}
+	if !stringsContains(string(b), "git-bob-github-com") {
+		t.Fatalf("bob alias should be kept: %s", b)
+	}
+
+	if err := Remove(d, cfg, "alice", false, false); err == nil {
+		t.Fatal("expected error removing unknown profile")
+	}
+}
+
+func TestRemoveShred(t *testing.T) {
+	d := t.TempDir()
+	if err := Init(d); err != nil {
+		t.Fatal(err)
+	}
+	priv, _, err := Add(d, "ed25519", Profile{Name: "alice", Email: "alice@example.com"}, key.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Remove(d, filepath.Join(d, "config"), "alice", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(priv); !os.IsNotExist(err) {
+		t.Fatalf("private key should be deleted, stat err: %v", err)
+	}
+	if archived, _ := filepath.Glob(filepath.Join(d, "backups", "keys", "*")); len(archived) != 0 {
+		t.Fatalf("shred should not archive keys: %v", archived)
+	}
+}
+
+func TestRemoveSSHCommandRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	d, cfg := newSyncedStore(t)
+	repo := filepath.Join(t.TempDir(), "repo")
+	if out, err := exec.Command("git", "init", "-q", repo).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	if out, err := exec.Command("git", "-C", repo, "remote", "add", "origin", "git@github.com:acme/repo.git").CombinedOutput(); err != nil {
+		t.Fatalf("git remote add: %v: %s", err, out)
+	}
+	// the remote keeps the canonical host, so only core.sshCommand ties it to the profile
+	if _, err := Use(d, "work", repo, true); err != nil {
+		t.Fatal(err)
+	}
+	top, _ := repoTopLevel(repo)
+	if inUse, err := profileRepos(d, "work"); err != nil || !slices.Equal(inUse, []string{top}) {
+		t.Fatalf("profileRepos = %v (%v)", inUse, err)
+	}
+	if err := Remove(d, cfg, "work", false, false); err == nil || !strings.Contains(err.Error(), top) {
+		t.Fatalf("expected removal refused for %s, got %v", top, err)
+	}
+	if err := Remove(d, cfg, "work", false, true); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/snowmerak/gipo/fsutil"
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+// FileRepair is the repair of the managed blocks of one ssh config file.
+type FileRepair struct {
+	ConfigChange
+	Problems []sshconfig.Problem
+}
+
+// PlanRepair returns the repairs needed by the files holding managed entries (see
+// sshConfigFiles), without changing them. Files without problems are left out.
+// If oldOwner is set, the blocks it owns are given to this store, for a store that moved
+// and got a new owner id (see storeOwner).
+func PlanRepair(baseDir, cfgPath, oldOwner string) ([]FileRepair, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if cfgPath == "" {
+		home, _ := os.UserHomeDir()
+		cfgPath = filepath.Join(home, ".ssh", "config")
+	}
+
+	files, err := sshConfigFiles(baseDir, cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	var repairs []FileRepair
+	for _, f := range files {
+		content, err := readConfig(f)
+		if err != nil {
+			return nil, err
+		}
+		repaired, problems := sshconfig.Repair(content)
+		if oldOwner != "" {
+			var reowned []sshconfig.Problem
+			repaired, reowned = sshconfig.Reown(repaired, oldOwner, storeOwner(baseDir))
+			problems = append(problems, reowned...)
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		repairs = append(repairs, FileRepair{
+			ConfigChange: ConfigChange{Path: f, Before: content, After: repaired},
+			Problems:     problems,
+		})
+	}
+	return repairs, nil
+}
+
+// RepairSSHConfig applies the repairs calculated by PlanRepair. The files are locked while
+// they are read and replaced, and a snapshot of them is saved first.
+func RepairSSHConfig(baseDir, cfgPath, oldOwner string) ([]FileRepair, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if cfgPath == "" {
+		home, _ := os.UserHomeDir()
+		cfgPath = filepath.Join(home, ".ssh", "config")
+	}
+
+	files, err := sshConfigFiles(baseDir, cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		lock, err := fsutil.Acquire(f)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Unlock()
+	}
+
+	repairs, err := PlanRepair(baseDir, cfgPath, oldOwner)
+	if err != nil || len(repairs) == 0 {
+		return nil, err
+	}
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if keep := settings.snapshotKeep(); keep > 0 {
+		if _, err := saveSnapshot(baseDir, "repair", files, keep); err != nil {
+			return nil, fmt.Errorf("failed to snapshot ssh config: %w", err)
+		}
+	}
+	for _, r := range repairs {
+		if err := fsutil.WriteFile(r.Path, []byte(r.After), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return repairs, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+func TestRepairSSHConfig(t *testing.T) {
+	d, cfg := newSyncedStore(t)
+	// a hand edit dropped the END marker
+	os.WriteFile(cfg, []byte("# BEGIN GITPROFILES git-work-github-com\nHost git-work-github-com\n    HostName github.com\n\nHost mine\n    User me\n"), 0o600)
+
+	var de *sshconfig.DamagedError
+	if _, err := PlanSSHConfig(d, cfg, true); !errors.As(err, &de) {
+		t.Fatalf("expected status to report the damage, got %v", err)
+	}
+
+	repairs, err := PlanRepair(d, cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 1 || repairs[0].Path != cfg || repairs[0].Problems[0].Kind != sshconfig.MissingEnd {
+		t.Fatalf("unexpected repair plan: %#v", repairs)
+	}
+	before, _ := ListSnapshots(d)
+	if _, err := RepairSSHConfig(d, cfg, ""); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(cfg); string(b) != repairs[0].After {
+		t.Fatalf("repair wrote:\n%s\nplan promised:\n%s", b, repairs[0].After)
+	}
+	if after, _ := ListSnapshots(d); len(after) != len(before)+1 || after[0].Reason != "repair" {
+		t.Fatalf("expected a repair snapshot, got %#v", after)
+	}
+	if repairs, err := PlanRepair(d, cfg, ""); err != nil || len(repairs) != 0 {
+		t.Fatalf("expected nothing left to repair, got %#v (%v)", repairs, err)
+	}
+
+	// sync works again and keeps the user's block
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := sshconfig.ListEntries(cfg)
+	if err != nil || len(entries) != 1 || entries[0].IdentityFile == "" {
+		t.Fatalf("unexpected entries after sync: %#v (%v)", entries, err)
+	}
+	if b, _ := os.ReadFile(cfg); !stringsContains(string(b), "Host mine\n    User me\n") {
+		t.Fatalf("expected unmanaged block kept:\n%s", b)
+	}
+}
+
+func TestRepairSSHConfigReown(t *testing.T) {
+	old, _ := newStore(t)
+	cfg := filepath.Join(t.TempDir(), "config")
+	if err := SyncSSHConfig(old, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	// the store moves: same profiles, new directory and owner id
+	moved := filepath.Join(t.TempDir(), "git_profiles")
+	if err := os.Rename(old, moved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PlanSSHConfig(moved, cfg, true); err == nil {
+		t.Fatal("expected the old blocks to be foreign after the move")
+	}
+
+	repairs, err := PlanRepair(moved, cfg, storeOwner(old))
+	if err != nil || len(repairs) != 1 || len(repairs[0].Problems) != 1 || repairs[0].Problems[0].Kind != sshconfig.OldOwner {
+		t.Fatalf("unexpected repair plan: %#v (%v)", repairs, err)
+	}
+	if _, err := RepairSSHConfig(moved, cfg, storeOwner(old)); err != nil {
+		t.Fatal(err)
+	}
+	// the blocks are the store's again; sync only points them at the moved keys
+	plan, err := PlanSSHConfig(moved, cfg, true)
+	if err != nil || len(plan.Removes)+len(plan.Foreign)+len(plan.Drift) != 0 {
+		t.Fatalf("expected the blocks owned by the moved store, got %#v (%v)", plan, err)
+	}
+	if err := SyncSSHConfig(moved, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := sshconfig.ListEntries(cfg)
+	if len(entries) != 1 || entries[0].Owner != storeOwner(moved) || filepath.Dir(filepath.Dir(entries[0].IdentityFile)) != moved {
+		t.Fatalf("unexpected entries after sync: %#v", entries)
+	}
+}
+
+func TestStoreOwnerSymlink(t *testing.T) {
+	d, _ := newStore(t)
+	link := filepath.Join(t.TempDir(), "profiles")
+	if err := os.Symlink(d, link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if storeOwner(link) != storeOwner(d) {
+		t.Fatalf("owner through symlink %s differs from %s", storeOwner(link), storeOwner(d))
+	}
+}
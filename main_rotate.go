@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/snowmerak/gipo/key"
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+// Rotate replaces the key pair of a profile with a newly generated one.
+// algo defaults to the profile's current algorithm, which must be one gipo can generate
+// (an imported rsa3072 key can't be). Without grace the old pair is archived
+// under <baseDir>/backups/keys. With grace it stays in keys/ under a timestamped name and is
+// kept as an extra IdentityFile until Retire is called.
+// opts selects the format and passphrase of the new private key.
+// Keys imported by reference are never moved; the profile simply stops using them.
+// Managed ssh config blocks of the profile that already exist in cfgPath are updated, and so
+// is the core.sshCommand gipo set in the profile's repositories.
+func Rotate(baseDir, cfgPath, profileName, algo string, grace bool, opts key.Options) (*Profile, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if cfgPath == "" {
+		home, _ := os.UserHomeDir()
+		cfgPath = filepath.Join(home, ".ssh", "config")
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	profile, ok := meta[profileName]
+	if !ok {
+		return nil, fmt.Errorf("profile '%s' not found", profileName)
+	}
+	if algo == "" {
+		// imported keys may use an algorithm gipo can't generate, e.g. rsa3072
+		if _, err := key.GetKeyGenerator(profile.Algo); err != nil {
+			return nil, fmt.Errorf("profile '%s' has a %s key, which gipo can't generate; choose the new key's algorithm with --algo", profileName, profile.Algo)
+		}
+		algo = profile.Algo
+	}
+
+	gen, err := key.GetKeyGenerator(algo)
+	if err != nil {
+		return nil, err
+	}
+	priv, pub, err := gen.Generate(profileName, profile.Email, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Move the old pair out of the way first; the new one may use the same file names.
+	now := time.Now().UTC()
+	stamp := now.Format("20060102T150405Z")
+	moved := make(map[string]string) // new location -> original location
+	undo := func() {
+		for to, from := range moved {
+			os.Rename(to, from)
+		}
+	}
+	moveOld := func(src string) (string, error) {
+		if src == "" {
+			return "", nil
+		}
+		var to string
+		var err error
+		if grace {
+			to = timestampedKeyPath(src, stamp)
+			err = os.Rename(src, to)
+		} else {
+			to, err = archiveKeyFile(baseDir, src, stamp)
+		}
+		if err != nil {
+			return "", err
+		}
+		moved[to] = src
+		return to, nil
+	}
+	old := PreviousKey{Algo: profile.Algo, Rotated: now, KeyRef: profile.KeyRef}
+	if profile.KeyRef {
+		old.Private, old.Public = profile.Private, profile.Public
+	} else {
+		if old.Private, err = moveOld(profile.Private); err != nil {
+			return nil, err
+		}
+		if old.Public, err = moveOld(profile.Public); err != nil {
+			undo()
+			return nil, err
+		}
+	}
+
+	privatePath, publicPath := keyFilePaths(baseDir, profileName, algo)
+	if err := writeKeyPair(privatePath, publicPath, priv, pub); err != nil {
+		undo()
+		return nil, err
+	}
+
+	if grace && old.Private != "" {
+		profile.PreviousKeys = append(profile.PreviousKeys, old)
+	}
+	profile.Algo = algo
+	profile.Private = privatePath
+	profile.Public = publicPath
+	profile.KeyRef = false
+	profile.Encrypted = opts.Passphrase != nil
+	if err := SaveProfiles(baseDir, meta); err != nil {
+		return nil, err
+	}
+
+	if err := updateManagedEntries(baseDir, cfgPath, profile); err != nil {
+		return profile, fmt.Errorf("key rotated but ssh config was not updated: %w", err)
+	}
+	if err := refreshSSHCommands(profile); err != nil {
+		return profile, fmt.Errorf("key rotated but core.sshCommand was not updated: %w", err)
+	}
+	return profile, nil
+}
+
+// Retire archives the keys kept by a grace rotation and drops them from the profile's
+// ssh config blocks and core.sshCommand. It returns the archived private key paths.
+func Retire(baseDir, cfgPath, profileName string) ([]string, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if cfgPath == "" {
+		home, _ := os.UserHomeDir()
+		cfgPath = filepath.Join(home, ".ssh", "config")
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	profile, ok := meta[profileName]
+	if !ok {
+		return nil, fmt.Errorf("profile '%s' not found", profileName)
+	}
+	if len(profile.PreviousKeys) == 0 {
+		return nil, nil
+	}
+
+	// Drop the keys from ssh config before archiving them so no block points at a missing file.
+	previous := profile.PreviousKeys
+	profile.PreviousKeys = nil
+	if err := updateManagedEntries(baseDir, cfgPath, profile); err != nil {
+		return nil, err
+	}
+	if err := refreshSSHCommands(profile); err != nil {
+		return nil, err
+	}
+	// Forget the keys before archiving them: a file that fails to move is only left over in
+	// keys/, while a profile listing already archived keys would break a retry.
+	if err := SaveProfiles(baseDir, meta); err != nil {
+		return nil, err
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	var retired []string
+	for _, k := range previous {
+		retired = append(retired, k.Private)
+		if k.KeyRef {
+			continue
+		}
+		for _, f := range []string{k.Private, k.Public} {
+			if _, err := archiveKeyFile(baseDir, f, stamp); err != nil && !os.IsNotExist(err) {
+				return retired, fmt.Errorf("keys retired but %s was not archived: %w", f, err)
+			}
+		}
+	}
+	return retired, nil
+}
+
+// timestampedKeyPath returns the name a key file keeps in keys/ during a grace rotation,
+// e.g. work_id_ed25519 -> work_id_ed25519.<stamp> and work_id_ed25519.pub -> work_id_ed25519.<stamp>.pub.
+func timestampedKeyPath(path, stamp string) string {
+	if ext := filepath.Ext(path); ext == ".pub" {
+		return path[:len(path)-len(ext)] + "." + stamp + ext
+	}
+	return path + "." + stamp
+}
+
+// updateManagedEntries rewrites the managed blocks of p that already exist in cfgPath
+// or in the include file. Aliases that were never synced are left for sync to add, and
+// blocks of other stores are left alone.
+func updateManagedEntries(baseDir, cfgPath string, p *Profile) error {
+	files, err := sshConfigFiles(baseDir, cfgPath)
+	if err != nil {
+		return err
+	}
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		existing, err := sshconfig.ListEntries(f)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		owner := storeOwner(baseDir)
+		present := make(map[string]bool, len(existing))
+		aliases := p.aliases(settings.AliasTemplate)
+		for _, e := range existing {
+			present[e.Alias] = ownedBy(e, owner, aliases)
+		}
+		for _, e := range profileEntries(p, settings.AliasTemplate, owner) {
+			if !present[e.Alias] {
+				continue
+			}
+			if err := sshconfig.AddOrReplaceEntry(f, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
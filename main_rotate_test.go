@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snowmerak/gipo/key"
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+func TestRotate(t *testing.T) {
+	d := t.TempDir()
+	if err := Init(d); err != nil {
+		t.Fatal(err)
+	}
+	priv, _, err := Add(d, "ed25519", Profile{Name: "alice", Email: "alice@example.com", Hosts: []string{"github.com"}}, key.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, _ := os.ReadFile(priv)
+	cfg := filepath.Join(d, "config")
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Rotate(d, cfg, "alice", "p256", false, key.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Algo != "p256" || p.Private != filepath.Join(d, "keys", "alice_id_p256") {
+		t.Fatalf("unexpected profile after rotate: %#v", p)
+	}
+	if _, err := os.Stat(priv); !os.IsNotExist(err) {
+		t.Fatalf("old key should be archived, stat err: %v", err)
+	}
+	if archived, _ := filepath.Glob(filepath.Join(d, "backups", "keys", "alice_id_ed25519.*")); len(archived) != 2 {
+		t.Fatalf("expected old pair archived, got %v", archived)
+	}
+	entries, err := sshconfig.ListEntries(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].IdentityFile != p.Private {
+		t.Fatalf("ssh config not updated: %#v", entries)
+	}
+
+	// same algorithm, with grace: old key stays in keys/ and in the ssh config
+	p, err = Rotate(d, cfg, "alice", "", true, key.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.PreviousKeys) != 1 {
+		t.Fatalf("expected one previous key, got %#v", p.PreviousKeys)
+	}
+	prev := p.PreviousKeys[0].Private
+	if filepath.Dir(prev) != filepath.Join(d, "keys") {
+		t.Fatalf("grace key should stay in keys/: %s", prev)
+	}
+	entries, _ = sshconfig.ListEntries(cfg)
+	if len(entries) != 1 || len(entries[0].ExtraIdentityFiles) != 1 || entries[0].ExtraIdentityFiles[0] != prev {
+		t.Fatalf("grace key not in ssh config: %#v", entries)
+	}
+	if adds, removes, err := PreviewSSHConfig(d, cfg, true); err != nil || len(adds) != 0 || len(removes) != 0 {
+		t.Fatalf("expected config in sync after rotate: %v %v %v", adds, removes, err)
+	}
+
+	retired, err := Retire(d, cfg, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retired) != 1 || retired[0] != prev {
+		t.Fatalf("unexpected retired keys: %v", retired)
+	}
+	if _, err := os.Stat(prev); !os.IsNotExist(err) {
+		t.Fatalf("retired key should be archived, stat err: %v", err)
+	}
+	entries, _ = sshconfig.ListEntries(cfg)
+	if len(entries) != 1 || len(entries[0].ExtraIdentityFiles) != 0 {
+		t.Fatalf("retired key still in ssh config: %#v", entries)
+	}
+	meta, _ := LoadProfiles(d)
+	if len(meta["alice"].PreviousKeys) != 0 {
+		t.Fatalf("previous keys not cleared: %#v", meta["alice"])
+	}
+
+	newKey, _ := os.ReadFile(meta["alice"].Private)
+	if string(newKey) == string(oldKey) {
+		t.Fatal("key was not replaced")
+	}
+}
+
+func TestRotateImportedRSA3072(t *testing.T) {
+	d, cfg := newStore(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(t.TempDir(), "id_rsa")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	if err := os.WriteFile(src, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Import(d, src, Profile{Name: "legacy", Email: "me@company.com", Hosts: []string{"github.com"}}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the profile's own algorithm can't be generated again, so rotate asks for one
+	_, err = Rotate(d, cfg, "legacy", "", false, key.Options{})
+	if err == nil || !strings.Contains(err.Error(), "rsa3072") || !strings.Contains(err.Error(), "--algo") {
+		t.Fatalf("expected error asking for --algo, got %v", err)
+	}
+	meta, _ := LoadProfiles(d)
+	if _, err := os.Stat(meta["legacy"].Private); err != nil {
+		t.Fatalf("key moved by a failed rotation: %v", err)
+	}
+
+	p, err := Rotate(d, cfg, "legacy", key.ED25519, false, key.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Algo != key.ED25519 || p.Private != filepath.Join(d, "keys", "legacy_id_ed25519") {
+		t.Fatalf("unexpected profile after rotation: %#v", p)
+	}
+}
+
+func TestRetireArchiveFailure(t *testing.T) {
+	d, cfg := newSyncedStore(t)
+	p, err := Rotate(d, cfg, "work", "", true, key.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := p.PreviousKeys[0].Private
+
+	// a file where the archive directory should be makes every archive fail
+	os.MkdirAll(filepath.Join(d, "backups"), 0o700)
+	if err := os.WriteFile(filepath.Join(d, "backups", "keys"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Retire(d, cfg, "work"); err == nil {
+		t.Fatal("expected archive error")
+	}
+	meta, _ := LoadProfiles(d)
+	if len(meta["work"].PreviousKeys) != 0 {
+		t.Fatalf("previous keys kept after a failed archive: %#v", meta["work"].PreviousKeys)
+	}
+	if _, err := os.Stat(prev); err != nil {
+		t.Fatalf("unarchived key should stay in keys/: %v", err)
+	}
+	// nothing is left to retry
+	if retired, err := Retire(d, cfg, "work"); err != nil || len(retired) != 0 {
+		t.Fatalf("retry = %v, %v", retired, err)
+	}
+}
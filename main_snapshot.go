@@ -0,0 +1,223 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/snowmerak/gipo/fsutil"
+)
+
+// defaultSnapshotKeep is the number of snapshots kept when snapshot.keep is not set.
+const defaultSnapshotKeep = 10
+
+// Snapshot is a copy of the ssh config files as they were before sync or a rollback
+// changed them. Each snapshot is a directory under backups/sshconfig in the base directory,
+// holding the copies and a snapshot.json describing them.
+type Snapshot struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// Reason is the command that replaced the files: "sync", "rollback" or "repair".
+	Reason string         `json:"reason"`
+	Files  []SnapshotFile `json:"files"`
+}
+
+// SnapshotFile is one file of a snapshot.
+type SnapshotFile struct {
+	// Path is where the file lives; Name is its copy inside the snapshot directory.
+	Path string `json:"path"`
+	Name string `json:"name,omitempty"`
+	// Missing records that the file didn't exist, so restoring it deletes it.
+	Missing bool `json:"missing,omitempty"`
+}
+
+func snapshotsDir(baseDir string) string {
+	return filepath.Join(baseDir, "backups", "sshconfig")
+}
+
+// saveSnapshot copies paths into a new snapshot and then deletes the oldest snapshots
+// beyond keep. The caller holds the locks of paths.
+func saveSnapshot(baseDir, reason string, paths []string, keep int) (*Snapshot, error) {
+	root := snapshotsDir(baseDir)
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	snap := &Snapshot{ID: now.Format("20060102-150405"), Created: now, Reason: reason}
+	// two snapshots within a second get a numbered suffix
+	for i := 1; ; i++ {
+		err := os.Mkdir(filepath.Join(root, snap.ID), 0o700)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		snap.ID = now.Format("20060102-150405") + "-" + strconv.Itoa(i)
+	}
+	dir := filepath.Join(root, snap.ID)
+
+	for i, p := range paths {
+		f := SnapshotFile{Path: p}
+		b, err := os.ReadFile(p)
+		switch {
+		case os.IsNotExist(err):
+			f.Missing = true
+		case err != nil:
+			return nil, err
+		default:
+			f.Name = fmt.Sprintf("%d-%s", i, filepath.Base(p))
+			if err := os.WriteFile(filepath.Join(dir, f.Name), b, 0o600); err != nil {
+				return nil, err
+			}
+		}
+		snap.Files = append(snap.Files, f)
+	}
+	out, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := fsutil.WriteFile(filepath.Join(dir, "snapshot.json"), out, 0o600); err != nil {
+		return nil, err
+	}
+
+	snaps, err := ListSnapshots(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, old := range snaps[min(keep, len(snaps)):] {
+		if err := os.RemoveAll(filepath.Join(root, old.ID)); err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+// ListSnapshots returns the ssh config snapshots of baseDir, newest first.
+func ListSnapshots(baseDir string) ([]Snapshot, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	root := snapshotsDir(baseDir)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var snaps []Snapshot
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(root, e.Name(), "snapshot.json"))
+		if err != nil {
+			// a snapshot interrupted before its manifest was written
+			continue
+		}
+		var s Snapshot
+		if err := json.Unmarshal(b, &s); err != nil {
+			return nil, fmt.Errorf("failed to parse snapshot %s: %w", e.Name(), err)
+		}
+		s.ID = e.Name()
+		snaps = append(snaps, s)
+	}
+	slices.SortFunc(snaps, func(a, b Snapshot) int {
+		if c := b.Created.Compare(a.Created); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.ID, a.ID)
+	})
+	return snaps, nil
+}
+
+// RollbackSSHConfig restores the files of snapshot id, or of the newest snapshot if id is
+// empty. The current files are snapshotted first, so a rollback can itself be rolled back.
+// It returns the restored snapshot and the one taken before restoring (nil if snapshots
+// are turned off).
+func RollbackSSHConfig(baseDir, id string) (restored, saved *Snapshot, err error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	snaps, err := ListSnapshots(baseDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, nil, errors.New("no ssh config snapshots found")
+	}
+	i := 0
+	if id != "" {
+		i = slices.IndexFunc(snaps, func(s Snapshot) bool { return s.ID == id })
+		if i < 0 {
+			return nil, nil, fmt.Errorf("snapshot '%s' not found (see 'gipo snapshots')", id)
+		}
+	}
+	restored = &snaps[i]
+
+	// the snapshot lists the files in sync's lock order
+	var paths []string
+	for _, f := range restored.Files {
+		paths = append(paths, f.Path)
+		if err := os.MkdirAll(filepath.Dir(f.Path), 0o700); err != nil {
+			return nil, nil, err
+		}
+		lock, err := fsutil.Acquire(f.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer lock.Unlock()
+	}
+
+	// read the copies before saving a snapshot may prune them
+	contents := make([][]byte, len(restored.Files))
+	for i, f := range restored.Files {
+		if f.Missing {
+			continue
+		}
+		if contents[i], err = os.ReadFile(filepath.Join(snapshotsDir(baseDir), restored.ID, f.Name)); err != nil {
+			return nil, nil, fmt.Errorf("snapshot '%s' is incomplete: %w", restored.ID, err)
+		}
+	}
+
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keep := settings.snapshotKeep(); keep > 0 {
+		if saved, err = saveSnapshot(baseDir, "rollback", paths, keep); err != nil {
+			return nil, nil, fmt.Errorf("failed to snapshot ssh config: %w", err)
+		}
+	}
+
+	for i, f := range restored.Files {
+		if f.Missing {
+			if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+				return nil, nil, err
+			}
+			continue
+		}
+		if err := fsutil.WriteFile(f.Path, contents[i], 0o600); err != nil {
+			return nil, nil, err
+		}
+	}
+	return restored, saved, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSyncSnapshotsAndRollback(t *testing.T) {
+	d, cfg := newStore(t)
+	original := "Host example\n    HostName example.com\n"
+	os.WriteFile(cfg, []byte(original), 0o600)
+
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	// a sync without changes takes no snapshot
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := ListSnapshots(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 1 || snaps[0].Reason != "sync" || len(snaps[0].Files) != 1 || snaps[0].Files[0].Path != cfg {
+		t.Fatalf("unexpected snapshots: %#v", snaps)
+	}
+	synced, _ := os.ReadFile(cfg)
+
+	restored, saved, err := RollbackSSHConfig(d, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.ID != snaps[0].ID || saved == nil || saved.Reason != "rollback" {
+		t.Fatalf("unexpected rollback result: %#v %#v", restored, saved)
+	}
+	if b, _ := os.ReadFile(cfg); string(b) != original {
+		t.Fatalf("expected original config restored, got:\n%s", b)
+	}
+	// the rollback can be undone
+	if _, _, err := RollbackSSHConfig(d, saved.ID); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(cfg); string(b) != string(synced) {
+		t.Fatalf("expected synced config back, got:\n%s", b)
+	}
+	if _, _, err := RollbackSSHConfig(d, "nope"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected unknown snapshot error, got %v", err)
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	d := t.TempDir()
+	if err := SetSetting(d, "snapshot.keep", "2"); err != nil {
+		t.Fatal(err)
+	}
+	cfg := filepath.Join(d, "config")
+	for i := range 4 {
+		os.WriteFile(cfg, []byte(strings.Repeat("#\n", i)), 0o600)
+		if _, err := saveSnapshot(d, "sync", []string{cfg, filepath.Join(d, "missing")}, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snaps, err := ListSnapshots(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snaps) != 2 || !snaps[0].Created.After(snaps[1].Created) {
+		t.Fatalf("expected the two newest snapshots, got %#v", snaps)
+	}
+	if !snaps[0].Files[1].Missing {
+		t.Fatalf("expected missing file to be recorded, got %#v", snaps[0].Files)
+	}
+
+	// restoring a file that didn't exist deletes it
+	os.WriteFile(filepath.Join(d, "missing"), []byte("x"), 0o600)
+	if _, _, err := RollbackSSHConfig(d, snaps[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be deleted, got %v", err)
+	}
+	if b, _ := os.ReadFile(cfg); string(b) != strings.Repeat("#\n", 3) {
+		t.Fatalf("unexpected restored content %q", b)
+	}
+
+	if err := SetSetting(d, "snapshot.keep", "-1"); err == nil {
+		t.Fatal("expected negative retention to be rejected")
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/snowmerak/gipo/diff"
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+// ANSI colors used by the diff output on terminals.
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+// exitPending is the exit code of `status --check` when sync has changes to make.
+// 1 is taken by errors and 2 by usage errors.
+const exitPending = 3
+
+// statusReport is the output of `status --json`.
+type statusReport struct {
+	Config string `json:"config"`
+	// InSync is false when sync has changes to make.
+	InSync   bool              `json:"in_sync"`
+	Include  *IncludePlan      `json:"include,omitempty"`
+	Creates  []statusCreate    `json:"creates"`
+	Updates  []statusUpdate    `json:"updates"`
+	Removals []statusRemoval   `json:"removals"`
+	Renames  []AliasRename     `json:"renames"`
+	Foreign  []sshconfig.Entry `json:"foreign"`
+	Unowned  []sshconfig.Entry `json:"unowned"`
+	// GitConfig lists the directory identities to change, if any profile has directories
+	// or gipo manages includeIf sections in the git config.
+	GitConfig *GitConfigPlan `json:"gitconfig,omitempty"`
+	// Diff is the output of --diff, if given.
+	Diff string `json:"diff,omitempty"`
+}
+
+type statusCreate struct {
+	Alias   string          `json:"alias"`
+	Profile string          `json:"profile"`
+	After   sshconfig.Entry `json:"after"`
+}
+
+type statusUpdate struct {
+	Alias   string                  `json:"alias"`
+	Profile string                  `json:"profile"`
+	Before  sshconfig.Entry         `json:"before"`
+	After   sshconfig.Entry         `json:"after"`
+	Changes []sshconfig.FieldChange `json:"changes"`
+	// HandModified reports that the block was edited by hand; Lines are the edited lines
+	// as in `gipo status`.
+	HandModified bool     `json:"hand_modified"`
+	Lines        []string `json:"lines,omitempty"`
+}
+
+type statusRemoval struct {
+	Alias  string          `json:"alias"`
+	Before sshconfig.Entry `json:"before"`
+}
+
+// newStatusReport builds the `status --json` report from the plans of PlanSSHConfig,
+// PreviewInclude and PlanGitConfig. Renamed aliases are also listed as a create and a removal.
+func newStatusReport(cfgPath string, ssh *SSHPlan, plan *IncludePlan, git *GitConfigPlan) statusReport {
+	r := statusReport{
+		Config:   cfgPath,
+		InSync:   len(ssh.Adds) == 0 && len(ssh.Removes) == 0 && plan.Empty() && git.Empty(),
+		Include:  plan,
+		Creates:  []statusCreate{},
+		Updates:  []statusUpdate{},
+		Removals: []statusRemoval{},
+		Renames:  slices.Concat([]AliasRename{}, ssh.Renames),
+		Foreign:  slices.Concat([]sshconfig.Entry{}, ssh.Foreign),
+		Unowned:  slices.Concat([]sshconfig.Entry{}, ssh.Unowned),
+	}
+	if !git.Empty() {
+		r.GitConfig = git
+	}
+	for _, e := range ssh.Adds {
+		cur, ok := ssh.Current[e.Alias]
+		if !ok {
+			r.Creates = append(r.Creates, statusCreate{Alias: e.Alias, Profile: ssh.Profiles[e.Alias], After: e})
+			continue
+		}
+		u := statusUpdate{Alias: e.Alias, Profile: ssh.Profiles[e.Alias], Before: cur, After: e, Changes: cur.Changes(e)}
+		if u.Changes == nil {
+			u.Changes = []sshconfig.FieldChange{}
+		}
+		if i := slices.IndexFunc(ssh.Drift, func(d BlockDrift) bool { return d.Alias == e.Alias }); i != -1 {
+			u.HandModified, u.Lines = true, driftLines(ssh.Drift[i])
+		}
+		r.Updates = append(r.Updates, u)
+	}
+	for _, a := range ssh.Removes {
+		r.Removals = append(r.Removals, statusRemoval{Alias: a, Before: ssh.Current[a]})
+	}
+	return r
+}
+
+// printSSHPlan writes the status summary: include changes, then renamed, created, updated
+// (with the directives that change) and removed entries, and the entries of other stores.
+func printSSHPlan(w io.Writer, cfgPath string, ssh *SSHPlan, plan *IncludePlan) {
+	if plan != nil && plan.AddInclude {
+		fmt.Fprintf(w, "Include to add to %s:\n  - %s\n", cfgPath, plan.Path)
+	}
+	if plan != nil && len(plan.Inline) > 0 {
+		fmt.Fprintf(w, "Inline entries to move to %s:\n", plan.Path)
+		for _, a := range plan.Inline {
+			fmt.Fprintf(w, "  - alias: %s\n", a)
+		}
+	}
+
+	// renamed aliases are listed once instead of as a create plus a remove
+	renamed := make(map[string]bool)
+	if len(ssh.Renames) > 0 {
+		fmt.Fprintln(w, "Aliases to rename:")
+		for _, r := range ssh.Renames {
+			fmt.Fprintf(w, "  - %s -> %s\n", r.From, r.To)
+			renamed[r.From], renamed[r.To] = true, true
+		}
+	}
+
+	if len(ssh.Drift) > 0 {
+		fmt.Fprintln(w, "Hand-modified entries (sync restores them unless adopted):")
+		for _, d := range ssh.Drift {
+			fmt.Fprintf(w, "  - alias: %s profile: %s file: %s\n", d.Alias, d.Profile, d.Path)
+			for _, l := range driftLines(d) {
+				fmt.Fprintf(w, "      %s\n", l)
+			}
+		}
+	}
+	drifted := make(map[string]bool)
+	for _, d := range ssh.Drift {
+		drifted[d.Alias] = true
+	}
+
+	var creates, updates []sshconfig.Entry
+	for _, e := range ssh.Adds {
+		switch cur, ok := ssh.Current[e.Alias]; {
+		case renamed[e.Alias]:
+		case ok && drifted[e.Alias] && len(cur.Changes(e)) == 0:
+			// already listed with its lines
+		case ok:
+			updates = append(updates, e)
+		default:
+			creates = append(creates, e)
+		}
+	}
+	if len(creates) > 0 {
+		fmt.Fprintln(w, "Entries to create:")
+		for _, e := range creates {
+			fmt.Fprintf(w, "  - alias: %s host: %s identity: %s\n", e.Alias, e.HostName, e.IdentityFile)
+		}
+	}
+	if len(updates) > 0 {
+		fmt.Fprintln(w, "Entries to update:")
+		for _, e := range updates {
+			fmt.Fprintf(w, "  - alias: %s\n", e.Alias)
+			changes := ssh.Current[e.Alias].Changes(e)
+			if len(changes) == 0 {
+				fmt.Fprintln(w, "      (rewritten in gipo's layout)")
+			}
+			for _, c := range changes {
+				fmt.Fprintf(w, "      %s: %s -> %s\n", c.Field, orNone(c.Before), orNone(c.After))
+			}
+		}
+	}
+
+	removes := slices.DeleteFunc(slices.Clone(ssh.Removes), func(a string) bool { return renamed[a] })
+	if len(removes) > 0 {
+		fmt.Fprintln(w, "Entries to remove:")
+		for _, a := range removes {
+			fmt.Fprintf(w, "  - alias: %s\n", a)
+		}
+	}
+
+	if len(ssh.Foreign) > 0 {
+		fmt.Fprintln(w, "Foreign entries (owned by other gipo stores, left alone):")
+		for _, e := range ssh.Foreign {
+			fmt.Fprintf(w, "  - alias: %s owner: %s\n", e.Alias, e.Owner)
+		}
+	}
+
+	if len(ssh.Unowned) > 0 {
+		fmt.Fprintln(w, "Unowned entries (written before stores were tagged, not pruned; delete them by hand if unused):")
+		for _, e := range ssh.Unowned {
+			fmt.Fprintf(w, "  - alias: %s\n", e.Alias)
+		}
+	}
+}
+
+// printGitConfigPlan writes the directory identities sync adds to and removes from the
+// git config, and the profile fragments it writes or deletes.
+func printGitConfigPlan(w io.Writer, git *GitConfigPlan) {
+	if git.Empty() {
+		return
+	}
+	if len(git.Adds) > 0 {
+		fmt.Fprintf(w, "Directory identities to add to %s:\n", git.Path)
+		for _, in := range git.Adds {
+			fmt.Fprintf(w, "  - dir: %s profile: %s\n", in.Dir, in.Profile)
+		}
+	}
+	if len(git.Removes) > 0 {
+		fmt.Fprintf(w, "Directory identities to remove from %s:\n", git.Path)
+		for _, in := range git.Removes {
+			fmt.Fprintf(w, "  - dir: %s profile: %s\n", in.Dir, in.Profile)
+		}
+	}
+	var writes, deletes []string
+	for _, c := range git.Changes {
+		switch {
+		case c.Path == git.Path:
+		case c.After == "":
+			deletes = append(deletes, c.Path)
+		default:
+			writes = append(writes, c.Path)
+		}
+	}
+	if len(writes) > 0 {
+		fmt.Fprintln(w, "Git config fragments to write:")
+		for _, f := range writes {
+			fmt.Fprintf(w, "  - %s\n", f)
+		}
+	}
+	if len(deletes) > 0 {
+		fmt.Fprintln(w, "Git config fragments to delete:")
+		for _, f := range deletes {
+			fmt.Fprintf(w, "  - %s\n", f)
+		}
+	}
+}
+
+// driftLines returns the lines of a drifted block that differ from gipo's version:
+// "-" for lines gipo wrote and "+" for lines as found.
+func driftLines(d BlockDrift) []string {
+	// the markers carry checksums, which are not what was edited
+	body := func(block string) string {
+		lines := strings.SplitAfter(block, "\n")
+		if len(lines) < 3 {
+			return block
+		}
+		return strings.Join(lines[1:len(lines)-2], "")
+	}
+	var out []string
+	for _, l := range strings.Split(diff.Unified("", "", body(d.Expected), body(d.Current), 0), "\n") {
+		if strings.HasPrefix(l, "-") && !strings.HasPrefix(l, "---") || strings.HasPrefix(l, "+") && !strings.HasPrefix(l, "+++") {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
+
+// printConfigDiff writes a unified diff for each changed file, colored if color is true.
+// action names the command making the changes, for the "+++" label.
+func printConfigDiff(w io.Writer, changes []ConfigChange, action string, color bool) {
+	for _, c := range changes {
+		d := diff.Unified(c.Path, c.Path+" (after "+action+")", c.Before, c.After, 3)
+		if !color {
+			fmt.Fprint(w, d)
+			continue
+		}
+		for _, line := range strings.SplitAfter(d, "\n") {
+			switch {
+			case line == "":
+			case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+				fmt.Fprint(w, colorBold+strings.TrimSuffix(line, "\n")+colorReset+"\n")
+			case strings.HasPrefix(line, "@@"):
+				fmt.Fprint(w, colorCyan+strings.TrimSuffix(line, "\n")+colorReset+"\n")
+			case strings.HasPrefix(line, "-"):
+				fmt.Fprint(w, colorRed+strings.TrimSuffix(line, "\n")+colorReset+"\n")
+			case strings.HasPrefix(line, "+"):
+				fmt.Fprint(w, colorGreen+strings.TrimSuffix(line, "\n")+colorReset+"\n")
+			default:
+				fmt.Fprint(w, line)
+			}
+		}
+	}
+}
+
+// useColor reports whether f is a terminal and NO_COLOR is not set.
+func useColor(f *os.File) bool {
+	return os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(f.Fd()))
+}
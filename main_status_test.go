@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+func TestStatusReport(t *testing.T) {
+	d, cfg := newStore(t)
+	os.WriteFile(cfg, []byte("# BEGIN GITPROFILES git-stale owner="+storeOwner(d)+"\nHost git-stale\n    HostName oldhost\n# END GITPROFILES git-stale\n"), 0o600)
+
+	report := func() statusReport {
+		t.Helper()
+		ssh, err := PlanSSHConfig(d, cfg, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := PreviewInclude(d, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newStatusReport(cfg, ssh, plan, nil)
+	}
+
+	r := report()
+	if r.InSync || len(r.Creates) != 1 || r.Creates[0].Profile != "work" || r.Creates[0].After.HostName != "github.com" {
+		t.Fatalf("unexpected creates: %#v", r)
+	}
+	if len(r.Removals) != 1 || r.Removals[0].Alias != "git-stale" || r.Removals[0].Before.HostName != "oldhost" {
+		t.Fatalf("unexpected removals: %#v", r.Removals)
+	}
+
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if r := report(); !r.InSync || len(r.Creates)+len(r.Updates)+len(r.Removals) != 0 {
+		t.Fatalf("expected in sync after sync, got %#v", r)
+	}
+
+	if _, _, _, err := Edit(d, "work", ProfileEdit{SetSSHOptions: []sshconfig.Option{{Key: "Port", Value: "2222"}}}); err != nil {
+		t.Fatal(err)
+	}
+	r = report()
+	if r.InSync || len(r.Updates) != 1 {
+		t.Fatalf("expected one update, got %#v", r)
+	}
+	u := r.Updates[0]
+	if u.HandModified || len(u.Changes) != 1 || u.Changes[0] != (sshconfig.FieldChange{Field: "Port", Before: "", After: "2222"}) {
+		t.Fatalf("unexpected update: %#v", u)
+	}
+
+	// the JSON keys are part of the interface scripts rely on
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"config", "in_sync", "creates", "updates", "removals", "renames", "foreign", "unowned"} {
+		if _, ok := m[k]; !ok {
+			t.Errorf("missing key %q in %s", k, b)
+		}
+	}
+	upd := m["updates"].([]any)[0].(map[string]any)
+	if upd["before"].(map[string]any)["hostname"] != "github.com" || upd["after"].(map[string]any)["options"] == nil {
+		t.Errorf("unexpected update JSON: %v", upd)
+	}
+}
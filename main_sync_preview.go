@@ -1,24 +1,79 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
 
+	"github.com/snowmerak/gipo/fsutil"
 	"github.com/snowmerak/gipo/sshconfig"
 )
 
+// SSHPlan describes the changes sync makes to the managed ssh config entries.
+type SSHPlan struct {
+	// Adds are entries to create or update.
+	Adds []sshconfig.Entry
+	// Removes are managed aliases to delete (prune only).
+	Removes []string
+	// Renames pair a removed alias with the added alias for the same host and key, e.g.
+	// after the alias template changed. Both sides are also listed in Adds and Removes.
+	Renames []AliasRename
+	// Current holds the entries as they are now for updated and removed aliases.
+	// An alias in Adds without a current entry is created.
+	Current map[string]sshconfig.Entry
+	// Profiles maps the aliases of this store to their profile names.
+	Profiles map[string]string
+	// Foreign are managed entries owned by other profile stores; sync leaves them alone.
+	Foreign []sshconfig.Entry
+	// Unowned are managed entries from before blocks had owners whose alias no profile of
+	// this store produces. They may belong to another store, so sync never prunes them.
+	Unowned []sshconfig.Entry
+	// Drift are managed blocks edited by hand. Their entries are also in Adds, so sync
+	// restores them unless the edits are adopted first (see AdoptDrift).
+	Drift []BlockDrift
+}
+
+// BlockDrift is a managed block that differs from what gipo wrote.
+type BlockDrift struct {
+	Alias   string
+	Profile string
+	Path    string
+	// Current is the block as found and Expected the block sync writes, markers included.
+	Current, Expected string
+}
+
+// AliasRename is a managed alias replaced by another for the same host and key.
+type AliasRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
 // PreviewSSHConfig returns entries to add/update and aliases to remove (if prune==true).
 // It compares the desired state (from keys.json) with the current state (from ssh config file).
 // baseDir is the root directory of gitprofiles (default: ~/.ssh/git_profiles).
-// cfgPath is the path to the ssh config file (default: ~/.ssh/config).
+// cfgPath is the path to the ssh config file (default: ~/.ssh/config). When the ssh.include
+// setting is set, the entries are compared against that file instead.
 // prune indicates whether to remove managed entries that are no longer in keys.json.
 func PreviewSSHConfig(baseDir, cfgPath string, prune bool) (adds []sshconfig.Entry, removes []string, err error) {
+	plan, err := PlanSSHConfig(baseDir, cfgPath, prune)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan.Adds, plan.Removes, nil
+}
+
+// PlanSSHConfig is PreviewSSHConfig returning the full plan, including alias renames.
+// Every block between gipo's markers is considered managed, whatever its alias, but only
+// blocks owned by this store (see storeOwner) are updated or pruned. A block without an
+// owner is claimed when this store produces its alias, and otherwise left alone.
+func PlanSSHConfig(baseDir, cfgPath string, prune bool) (*SSHPlan, error) {
 	if baseDir == "" {
 		home, err := os.UserHomeDir()
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		baseDir = filepath.Join(home, ".ssh", "git_profiles")
 	}
@@ -29,72 +84,404 @@ func PreviewSSHConfig(baseDir, cfgPath string, prune bool) (adds []sshconfig.Ent
 
 	meta, err := LoadProfiles(baseDir)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return nil, err
 	}
 
 	desired := make(map[string]sshconfig.Entry)
-	for name, info := range meta {
-		host := info["host"]
-		priv := info["private"]
-		if host == "" || priv == "" {
-			continue
+	owners := make(map[string]string)
+	profiles := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(meta)) {
+		p := meta[name]
+		for _, e := range profileEntries(p, settings.AliasTemplate, storeOwner(baseDir)) {
+			owner := fmt.Sprintf("profile '%s' on %s", name, e.HostName)
+			if prev, ok := owners[e.Alias]; ok {
+				return nil, fmt.Errorf("alias %s is used by both %s and %s; change the alias template", e.Alias, prev, owner)
+			}
+			owners[e.Alias] = owner
+			profiles[e.Alias] = name
+			desired[e.Alias] = e
 		}
-		alias := fmt.Sprintf("git-%s-%s", name, strings.ReplaceAll(host, ".", "-"))
-		desired[alias] = sshconfig.Entry{Alias: alias, HostName: host, User: "git", IdentityFile: priv}
 	}
 
-	existing, err := sshconfig.ListEntries(cfgPath)
-	if err != nil && !os.IsNotExist(err) {
-		return nil, nil, err
+	managedPath, err := managedSSHConfig(baseDir, cfgPath)
+	if err != nil {
+		return nil, err
 	}
 
-	// compute adds/updates
-	for alias, de := range desired {
-		found := false
-		for _, ex := range existing {
-			if ex.Alias == alias {
-				found = true
-				// if any field differs, mark for add/update
-				if ex.HostName != de.HostName || ex.User != de.User || ex.IdentityFile != de.IdentityFile {
-					adds = append(adds, de)
-				}
-				break
+	// refuse to take over an alias the user already defines in an unmanaged Host block
+	var conflicts []error
+	seen := make(map[string]bool)
+	for _, path := range slices.Compact([]string{cfgPath, managedPath}) {
+		cfg, err := sshconfig.ParseFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, alias := range slices.Sorted(maps.Keys(desired)) {
+			if err := cfg.Conflict(alias); err != nil && !seen[err.Error()] {
+				seen[err.Error()] = true
+				conflicts = append(conflicts, err)
 			}
 		}
-		if !found {
-			adds = append(adds, de)
+	}
+	if len(conflicts) > 0 {
+		return nil, errors.Join(conflicts...)
+	}
+
+	existing, err := sshconfig.ListEntries(managedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	managed, err := readConfig(managedPath)
+	if err != nil {
+		return nil, err
+	}
+	// in include mode, blocks still inline in the main config are moved by sync;
+	// stale ones are pruned instead of moved
+	var inline []sshconfig.Entry
+	if managedPath != cfgPath {
+		inline, err = sshconfig.ListEntries(cfgPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
 		}
 	}
 
-	if prune {
-		for _, ex := range existing {
-			if strings.HasPrefix(ex.Alias, "git-") {
-				if _, ok := desired[ex.Alias]; !ok {
-					removes = append(removes, ex.Alias)
-				}
+	plan := &SSHPlan{Current: make(map[string]sshconfig.Entry), Profiles: profiles}
+	owner := storeOwner(baseDir)
+	ours := slices.Collect(maps.Keys(desired))
+	for _, ex := range slices.Concat(existing, inline) {
+		switch {
+		case ownedBy(ex, owner, ours):
+		case ex.Owner == "":
+			if !slices.ContainsFunc(plan.Unowned, func(u sshconfig.Entry) bool { return u.Alias == ex.Alias }) {
+				plan.Unowned = append(plan.Unowned, ex)
 			}
+		default:
+			plan.Foreign = append(plan.Foreign, ex)
+		}
+	}
+	existing = slices.DeleteFunc(existing, func(ex sshconfig.Entry) bool { return !ownedBy(ex, owner, ours) })
+	inline = slices.DeleteFunc(inline, func(ex sshconfig.Entry) bool { return !ownedBy(ex, owner, ours) })
+
+	// compute adds/updates
+	var created []sshconfig.Entry
+	for _, alias := range slices.Sorted(maps.Keys(desired)) {
+		de := desired[alias]
+		if i := slices.IndexFunc(plan.Foreign, func(ex sshconfig.Entry) bool { return ex.Alias == alias }); i != -1 {
+			return nil, fmt.Errorf("alias %s is managed by another gipo store (owner %s); remove it there or change the alias template, or if that was this store before it moved, run 'gipo sshconfig repair --reown %s'", alias, plan.Foreign[i].Owner, plan.Foreign[i].Owner)
+		}
+		i := slices.IndexFunc(existing, func(ex sshconfig.Entry) bool { return ex.Alias == alias })
+		if i == -1 {
+			plan.Adds = append(plan.Adds, de)
+			created = append(created, de)
+			continue
+		}
+		// compare the whole block, not just the parsed entry: a deleted default option,
+		// a comment or a reformatted line are changes too
+		block, _ := sshconfig.ManagedBlock(managed, alias)
+		drift := sshconfig.HandModified(block)
+		if drift {
+			plan.Drift = append(plan.Drift, BlockDrift{
+				Alias: alias, Profile: profiles[alias], Path: managedPath,
+				Current: block, Expected: sshconfig.RenderEntry(de),
+			})
+		}
+		// blocks from before checksums are rewritten to get one
+		if drift || !existing[i].Equal(de) || !sshconfig.HasChecksum(block) {
+			plan.Adds = append(plan.Adds, de)
+			plan.Current[alias] = existing[i]
+		}
+	}
+
+	if !prune {
+		return plan, nil
+	}
+	var stale []sshconfig.Entry
+	for _, ex := range slices.Concat(existing, inline) {
+		if _, ok := desired[ex.Alias]; !ok && !slices.Contains(plan.Removes, ex.Alias) {
+			plan.Removes = append(plan.Removes, ex.Alias)
+			plan.Current[ex.Alias] = ex
+			stale = append(stale, ex)
+		}
+	}
+
+	// a created alias replacing a removed one for the same host and key is a rename
+	for _, c := range created {
+		i := slices.IndexFunc(stale, func(ex sshconfig.Entry) bool {
+			return ex.HostName == c.HostName && ex.IdentityFile == c.IdentityFile
+		})
+		if i == -1 {
+			continue
+		}
+		plan.Renames = append(plan.Renames, AliasRename{From: stale[i].Alias, To: c.Alias})
+		stale = slices.Delete(stale, i, i+1)
+	}
+	return plan, nil
+}
+
+// profileEntries returns the managed ssh config entries for p, one per host.
+// Keys still in their rotation grace period are listed after the current key.
+// aliasTemplate is the alias.template setting and owner the id of the store.
+func profileEntries(p *Profile, aliasTemplate, owner string) []sshconfig.Entry {
+	if p.Private == "" {
+		return nil
+	}
+	extra := previousKeyPaths(p)
+	out := make([]sshconfig.Entry, 0, len(p.Hosts))
+	for _, host := range p.Hosts {
+		out = append(out, sshconfig.Entry{
+			Alias:              p.alias(aliasTemplate, host),
+			HostName:           host,
+			User:               "git",
+			IdentityFile:       p.Private,
+			ExtraIdentityFiles: extra,
+			Options:            p.SSHOptions,
+			Owner:              owner,
+		})
+	}
+	return out
+}
+
+// IncludePlan describes the changes sync makes to the main ssh config in include mode.
+type IncludePlan struct {
+	// Path is the include file holding the managed entries.
+	Path string `json:"path"`
+	// AddInclude reports that the Include line for Path is missing from the main config.
+	AddInclude bool `json:"add_include"`
+	// Inline are managed blocks of this store still in the main config; sync moves them
+	// to Path. Blocks of other stores stay where they are.
+	Inline []string `json:"inline"`
+}
+
+// PreviewInclude returns the changes needed to the main ssh config when the ssh.include
+// setting is set, or nil when entries are written inline.
+func PreviewInclude(baseDir, cfgPath string) (*IncludePlan, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if cfgPath == "" {
+		home, _ := os.UserHomeDir()
+		cfgPath = filepath.Join(home, ".ssh", "config")
+	}
+
+	managedPath, err := managedSSHConfig(baseDir, cfgPath)
+	if err != nil || managedPath == cfgPath {
+		return nil, err
+	}
+	plan := &IncludePlan{Path: managedPath, AddInclude: true}
+	cfg, err := sshconfig.ParseFile(cfgPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return plan, nil
+		}
+		return nil, err
+	}
+	plan.AddInclude = !cfg.Includes(managedPath)
+	inline, err := sshconfig.ListEntries(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	ours, err := storeAliases(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range inline {
+		if ownedBy(e, storeOwner(baseDir), ours) {
+			plan.Inline = append(plan.Inline, e.Alias)
+		}
+	}
+	return plan, nil
+}
+
+// Empty reports whether the plan has nothing to do.
+func (p *IncludePlan) Empty() bool {
+	return p == nil || (!p.AddInclude && len(p.Inline) == 0)
+}
+
+// ConfigChange is the content of a config file gipo writes, before and after sync.
+type ConfigChange struct {
+	Path   string
+	Before string
+	After  string
+}
+
+// RenderSync returns the files SyncSSHConfig would change and their new content,
+// without writing anything. The managed file comes first.
+func RenderSync(baseDir, cfgPath string, prune bool) ([]ConfigChange, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if cfgPath == "" {
+		home, _ := os.UserHomeDir()
+		cfgPath = filepath.Join(home, ".ssh", "config")
+	}
+
+	ssh, err := PlanSSHConfig(baseDir, cfgPath, prune)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := PreviewInclude(baseDir, cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	managedPath, err := managedSSHConfig(baseDir, cfgPath)
+	if err != nil {
+		return nil, err
+	}
+
+	managed, err := readConfig(managedPath)
+	if err != nil {
+		return nil, err
+	}
+	after := managed
+	for _, e := range ssh.Adds {
+		after = sshconfig.SetEntry(after, e)
+	}
+	for _, a := range ssh.Removes {
+		if after, err = sshconfig.DeleteEntry(after, a); err != nil {
+			return nil, err
+		}
+	}
+	if plan.Empty() {
+		if after == managed {
+			return nil, nil
+		}
+		return []ConfigChange{{Path: managedPath, Before: managed, After: after}}, nil
+	}
+
+	main, err := readConfig(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	// Copy inline blocks that sync didn't already write, include the file and drop
+	// the inline copies. The include file is written first, so no alias is ever missing.
+	present := sshconfig.Entries(after)
+	for _, e := range sshconfig.Entries(main) {
+		if !slices.Contains(plan.Inline, e.Alias) || slices.Contains(ssh.Removes, e.Alias) || slices.ContainsFunc(present, func(p sshconfig.Entry) bool { return p.Alias == e.Alias }) {
+			continue
+		}
+		after = sshconfig.SetEntry(after, e)
+	}
+	mainAfter, _, err := sshconfig.SetInclude(main, cfgPath, managedPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range plan.Inline {
+		if mainAfter, err = sshconfig.DeleteEntry(mainAfter, a); err != nil {
+			return nil, err
 		}
 	}
 
-	return adds, removes, nil
+	var changes []ConfigChange
+	if after != managed {
+		changes = append(changes, ConfigChange{Path: managedPath, Before: managed, After: after})
+	}
+	if mainAfter != main {
+		changes = append(changes, ConfigChange{Path: cfgPath, Before: main, After: mainAfter})
+	}
+	return changes, nil
+}
+
+// readConfig returns the content of an ssh config file; a missing file is empty.
+func readConfig(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return string(b), nil
 }
 
 // SyncSSHConfig applies the changes calculated by PreviewSSHConfig to the ssh config file.
 // It adds or updates entries for profiles and removes stale entries if prune is true.
+// In include mode it also moves inline managed blocks to the include file and makes sure
+// the main config includes it. The files are locked while they are read and replaced, and
+// a snapshot of them is saved first (see RollbackSSHConfig).
 func SyncSSHConfig(baseDir, cfgPath string, prune bool) error {
-	adds, removes, err := PreviewSSHConfig(baseDir, cfgPath, prune)
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	if cfgPath == "" {
+		home, _ := os.UserHomeDir()
+		cfgPath = filepath.Join(home, ".ssh", "config")
+	}
+
+	files, err := sshConfigFiles(baseDir, cfgPath)
 	if err != nil {
 		return err
 	}
-	for _, e := range adds {
-		if err := sshconfig.AddOrReplaceEntry(cfgPath, e); err != nil {
+	// always managed file first, then the main config, like every other writer
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f), 0o700); err != nil {
+			return err
+		}
+		lock, err := fsutil.Acquire(f)
+		if err != nil {
 			return err
 		}
+		defer lock.Unlock()
+	}
+
+	changes, err := RenderSync(baseDir, cfgPath, prune)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return err
+	}
+	if keep := settings.snapshotKeep(); keep > 0 {
+		if _, err := saveSnapshot(baseDir, "sync", files, keep); err != nil {
+			return fmt.Errorf("failed to snapshot ssh config: %w", err)
+		}
 	}
-	for _, a := range removes {
-		if err := sshconfig.RemoveEntry(cfgPath, a); err != nil {
+	for _, c := range changes {
+		if err := fsutil.WriteFile(c.Path, []byte(c.After), 0o600); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// renamedAliasRepos returns, per rename, the recorded repositories whose remotes still use
+// the old alias.
+func renamedAliasRepos(baseDir string, renames []AliasRename) (map[AliasRename][]string, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[AliasRename][]string)
+	for _, r := range renames {
+		for _, p := range meta {
+			out[r] = append(out[r], reposUsingAlias(p, r.From)...)
+		}
+	}
+	return out, nil
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/snowmerak/gipo/sshconfig"
 )
 
 func TestPreviewSSHConfig(t *testing.T) {
@@ -55,3 +58,38 @@ func TestPreviewSSHConfig(t *testing.T) {
 		t.Fatalf("unexpected alias: %s", adds[0].Alias)
 	}
 }
+
+func TestPreviewSSHConfigMultipleHosts(t *testing.T) {
+	d, cfg := newStore(t, Profile{Name: "work", Email: "me@company.com", Hosts: []string{"github.com", "gitlab.example.com"}})
+
+	adds, _, err := PreviewSSHConfig(d, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, e := range adds {
+		got[e.Alias] = e.HostName
+	}
+	if got["git-work-github-com"] != "github.com" || got["git-work-gitlab-example-com"] != "gitlab.example.com" || len(got) != 2 {
+		t.Fatalf("expected one alias per host, got %#v", adds)
+	}
+}
+
+func TestPreviewSSHConfigConflict(t *testing.T) {
+	d, cfg := newStore(t)
+	if err := os.WriteFile(cfg, []byte("Include extra.conf\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(d, "extra.conf"), []byte("Host git-work-github-com\n    HostName github.com\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := PreviewSSHConfig(d, cfg, false)
+	var conflict *sshconfig.ConflictError
+	if !errors.As(err, &conflict) || conflict.Alias != "git-work-github-com" {
+		t.Fatalf("expected conflict for git-work-github-com, got %v", err)
+	}
+	if err := SyncSSHConfig(d, cfg, false); err == nil {
+		t.Fatal("expected sync to refuse the conflicting alias")
+	}
+}
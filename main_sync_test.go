@@ -4,7 +4,12 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+
+	"github.com/snowmerak/gipo/key"
+	"github.com/snowmerak/gipo/sshconfig"
 )
 
 func TestSyncSSHConfig(t *testing.T) {
@@ -40,7 +45,7 @@ func TestSyncSSHConfig(t *testing.T) {
 
 	cfg := filepath.Join(d, "config")
 	// add a stale entry to cfg
-	os.WriteFile(cfg, []byte("# BEGIN GITPROFILES git-stale\nHost git-stale\n    HostName oldhost\n# END GITPROFILES git-stale\n"), 0o600)
+	os.WriteFile(cfg, []byte("# BEGIN GITPROFILES git-stale owner="+storeOwner(d)+"\nHost git-stale\n    HostName oldhost\n# END GITPROFILES git-stale\n"), 0o600)
 
 	// run sync with prune = true
 	if err := SyncSSHConfig(d, cfg, true); err != nil {
@@ -82,3 +87,241 @@ func indexOf(s, sub string) int {
 	}
 	return -1
 }
+
+func TestSyncSSHConfigIncludeMode(t *testing.T) {
+	d, cfg := newStore(t)
+	// an inline block from before include mode, plus an unrelated host
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(cfg)
+	os.WriteFile(cfg, append([]byte("Host example\n    HostName example.com\n\n"), b...), 0o600)
+
+	if err := SetSetting(d, "ssh.include", "config.d/gipo.conf"); err != nil {
+		t.Fatal(err)
+	}
+	inc := filepath.Join(d, "config.d", "gipo.conf")
+
+	plan, err := PreviewInclude(d, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan == nil || plan.Path != inc || !plan.AddInclude || len(plan.Inline) != 1 || plan.Inline[0] != "git-work-github-com" {
+		t.Fatalf("unexpected include plan: %#v", plan)
+	}
+
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	main, _ := os.ReadFile(cfg)
+	if !strings.HasPrefix(string(main), "Include "+filepath.ToSlash(inc)+"\n") && !strings.HasPrefix(string(main), "Include ~/") {
+		t.Fatalf("expected Include line at the top, got:\n%s", main)
+	}
+	if strings.Contains(string(main), "GITPROFILES") || !strings.Contains(string(main), "Host example") {
+		t.Fatalf("expected inline block moved and other hosts kept, got:\n%s", main)
+	}
+	entries, err := sshconfig.ListEntries(inc)
+	if err != nil || len(entries) != 1 || entries[0].Alias != "git-work-github-com" {
+		t.Fatalf("expected entry in include file, got %#v (%v)", entries, err)
+	}
+
+	// a second sync has nothing to do
+	plan, err = PreviewInclude(d, cfg)
+	if err != nil || !plan.Empty() {
+		t.Fatalf("expected empty plan after sync, got %#v (%v)", plan, err)
+	}
+	adds, removes, err := PreviewSSHConfig(d, cfg, true)
+	if err != nil || len(adds) != 0 || len(removes) != 0 {
+		t.Fatalf("expected no changes after sync, got %#v %#v (%v)", adds, removes, err)
+	}
+
+	// remove operates on the include file
+	if err := Remove(d, cfg, "work", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := sshconfig.ListEntries(inc); len(entries) != 0 {
+		t.Fatalf("expected entry removed from include file, got %#v", entries)
+	}
+}
+
+func TestPlanSSHConfigAliasTemplateRename(t *testing.T) {
+	d, cfg := newStore(t,
+		Profile{Name: "work", Email: "work@example.com", Hosts: []string{"github.com"}},
+		Profile{Name: "home", Email: "home@example.com", Hosts: []string{"github.com"}})
+	// a managed block whose alias doesn't follow any template is still pruned
+	os.WriteFile(cfg, []byte("# BEGIN GITPROFILES old.alias owner="+storeOwner(d)+"\nHost old.alias\n    HostName example.com\n# END GITPROFILES old.alias\n"), 0o600)
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(cfg); strings.Contains(string(b), "old.alias") {
+		t.Fatalf("expected managed block without git- prefix to be pruned:\n%s", b)
+	}
+
+	if err := SetSetting(d, "alias.template", "{host_short}-{profile}"); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := PlanSSHConfig(d, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AliasRename{{From: "git-home-github-com", To: "github-home"}, {From: "git-work-github-com", To: "github-work"}}
+	if !slices.Equal(plan.Renames, want) {
+		t.Fatalf("renames = %#v, want %#v", plan.Renames, want)
+	}
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := sshconfig.ListEntries(cfg)
+	if len(entries) != 2 || entries[0].Alias != "github-home" || entries[1].Alias != "github-work" {
+		t.Fatalf("unexpected entries after rename: %#v", entries)
+	}
+
+	// a per-profile template that collides with another profile's alias is rejected
+	tmpl := "github-home"
+	if _, _, _, err := Edit(d, "work", ProfileEdit{AliasTemplate: &tmpl}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PlanSSHConfig(d, cfg, true); err == nil {
+		t.Fatal("expected error for colliding aliases")
+	}
+	if err := SetSetting(d, "alias.template", "{host}"); err == nil {
+		t.Fatal("expected global template without {profile} to be rejected")
+	}
+}
+
+func TestRenderSyncMatchesSync(t *testing.T) {
+	d, cfg := newStore(t)
+	os.WriteFile(cfg, []byte("Host example\n    HostName example.com\n\n# BEGIN GITPROFILES git-stale owner="+storeOwner(d)+"\nHost git-stale\n    HostName oldhost\n# END GITPROFILES git-stale\n"), 0o600)
+
+	changes, err := RenderSync(d, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != cfg {
+		t.Fatalf("expected one change to %s, got %#v", cfg, changes)
+	}
+	var buf strings.Builder
+	printConfigDiff(&buf, changes, "sync", false)
+	out := buf.String()
+	if !strings.Contains(out, "-Host git-stale\n") || !strings.Contains(out, "+Host git-work-github-com\n") {
+		t.Fatalf("unexpected diff:\n%s", out)
+	}
+
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(cfg); string(b) != changes[0].After {
+		t.Fatalf("sync wrote:\n%s\nrender promised:\n%s", b, changes[0].After)
+	}
+	if changes, err := RenderSync(d, cfg, true); err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes after sync, got %#v (%v)", changes, err)
+	}
+}
+
+func TestSyncSSHConfigSeparateStores(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "config")
+	work, _ := newStore(t, Profile{Name: "work", Email: "work@example.com", Hosts: []string{"github.com"}})
+	client, _ := newStore(t, Profile{Name: "client", Email: "client@example.com", Hosts: []string{"github.com"}})
+
+	if err := SyncSSHConfig(work, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncSSHConfig(client, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := sshconfig.ListEntries(cfg)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected both stores' entries to survive prune, got %#v (%v)", entries, err)
+	}
+	for _, e := range entries {
+		d := work
+		if e.Alias == "git-client-github-com" {
+			d = client
+		}
+		if e.Owner != storeOwner(d) {
+			t.Fatalf("entry %s has owner %q, want %q", e.Alias, e.Owner, storeOwner(d))
+		}
+	}
+
+	plan, err := PlanSSHConfig(work, cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Adds) != 0 || len(plan.Removes) != 0 || len(plan.Foreign) != 1 || plan.Foreign[0].Alias != "git-client-github-com" {
+		t.Fatalf("unexpected plan for work store: %#v", plan)
+	}
+
+	// the same alias in two stores is refused instead of fought over
+	if _, _, err := Add(work, "ed25519", Profile{Name: "client", Email: "c@example.com", Hosts: []string{"github.com"}}, key.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PlanSSHConfig(work, cfg, true); err == nil || !strings.Contains(err.Error(), "another gipo store") {
+		t.Fatalf("expected foreign alias error, got %v", err)
+	}
+
+	// blocks from before owners existed are claimed only by the store producing their alias
+	b, _ := os.ReadFile(cfg)
+	legacy := "# BEGIN GITPROFILES git-legacy-github-com\nHost git-legacy-github-com\n    HostName github.com\n# END GITPROFILES git-legacy-github-com\n"
+	os.WriteFile(cfg, append(b, legacy...), 0o600)
+	if err := SyncSSHConfig(client, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(cfg); !strings.Contains(string(b), legacy) {
+		t.Fatalf("expected unowned block kept by prune, got:\n%s", b)
+	}
+	plan, err = PlanSSHConfig(client, cfg, true)
+	if err != nil || len(plan.Removes) != 0 || len(plan.Unowned) != 1 || plan.Unowned[0].Alias != "git-legacy-github-com" {
+		t.Fatalf("expected unowned block listed, got %#v (%v)", plan, err)
+	}
+	if _, _, err := Add(client, "ed25519", Profile{Name: "legacy", Email: "l@example.com", Hosts: []string{"github.com"}}, key.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncSSHConfig(client, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := sshconfig.ListEntries(cfg); !slices.ContainsFunc(entries, func(e sshconfig.Entry) bool {
+		return e.Alias == "git-legacy-github-com" && e.Owner == storeOwner(client)
+	}) {
+		t.Fatalf("expected unowned block claimed and tagged, got %#v", entries)
+	}
+	if err := Remove(client, cfg, "legacy", false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// removing a profile leaves the other store's block of the same alias alone
+	if err := Remove(work, cfg, "client", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := sshconfig.ListEntries(cfg); len(entries) != 2 {
+		t.Fatalf("expected foreign entry kept, got %#v", entries)
+	}
+}
+
+// newStore creates a profile store in a temporary directory holding profiles, by default
+// "work" on github.com, and returns it with the path of an ssh config inside it.
+func newStore(t *testing.T, profiles ...Profile) (baseDir, cfgPath string) {
+	t.Helper()
+	d := t.TempDir()
+	if err := Init(d); err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) == 0 {
+		profiles = []Profile{{Name: "work", Email: "me@company.com", Hosts: []string{"github.com"}}}
+	}
+	for _, p := range profiles {
+		if _, _, err := Add(d, "ed25519", p, key.Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d, filepath.Join(d, "config")
+}
+
+// newSyncedStore is newStore with the profiles synced to the ssh config.
+func newSyncedStore(t *testing.T, profiles ...Profile) (baseDir, cfgPath string) {
+	t.Helper()
+	d, cfg := newStore(t, profiles...)
+	if err := SyncSSHConfig(d, cfg, true); err != nil {
+		t.Fatal(err)
+	}
+	return d, cfg
+}
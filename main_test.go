@@ -3,22 +3,23 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/snowmerak/gipo/key"
 	"golang.org/x/crypto/ssh"
 )
 
 func TestInitAndAdd(t *testing.T) {
-	dir := os.TempDir()
-	defer os.RemoveAll(dir)
+	dir := t.TempDir()
 
 	if err := Init(dir); err != nil {
 		t.Fatalf("Init failed: %v", err)
 	}
 
 	// add a key
-	priv, pub, err := Add(dir, "ed25519", "alice", "alice@example.com", "github.com")
+	priv, pub, err := Add(dir, "ed25519", Profile{Name: "alice", Email: "alice@example.com", Hosts: []string{"github.com"}}, key.Options{})
 	if err != nil {
 		t.Fatalf("Add failed: %v", err)
 	}
@@ -57,4 +58,47 @@ func TestInitAndAdd(t *testing.T) {
 	if !strings.Contains(string(mb), "alice") {
 		t.Fatalf("meta does not contain alice: %s", string(mb))
 	}
+
+	profiles, err := LoadProfiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := profiles["alice"]
+	if !ok {
+		t.Fatalf("alice not loaded: %#v", profiles)
+	}
+	if p.Private != priv || p.Public != pub || p.Email != "alice@example.com" || !slices.Equal(p.Hosts, []string{"github.com"}) {
+		t.Fatalf("unexpected profile: %#v", p)
+	}
+	if p.Created.IsZero() {
+		t.Fatalf("created timestamp not recorded")
+	}
+}
+
+func TestAddWithPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(dir); err != nil {
+		t.Fatal(err)
+	}
+	priv, _, err := Add(dir, "ed25519", Profile{Name: "alice", Email: "alice@example.com"}, key.Options{Passphrase: []byte("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ssh.ParseRawPrivateKey(b); err == nil {
+		t.Fatal("expected encrypted private key")
+	}
+	if _, err := ssh.ParseRawPrivateKeyWithPassphrase(b, []byte("secret")); err != nil {
+		t.Fatalf("failed to decrypt private key: %v", err)
+	}
+	profiles, err := LoadProfiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !profiles["alice"].Encrypted {
+		t.Fatalf("profile not marked as encrypted: %#v", profiles["alice"])
+	}
 }
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// UseResult reports what Use changed in a repository.
+type UseResult struct {
+	// Dir is the top-level directory of the repository.
+	Dir string
+	// Previous is the profile the repository was recorded under before, if another one.
+	Previous string
+	// Remotes are the rewritten remote urls and pushurls.
+	Remotes []gitConfigChange
+	// Skipped are the remote urls left alone, with the reason.
+	Skipped []SkippedRemote
+	// Identity are the changed user.name, user.email and core.sshCommand values.
+	Identity []gitConfigChange
+}
+
+// sshCommandProfileKey is the local git config key naming the profile whose
+// core.sshCommand gipo set in a repository. It tells gipo's command from the user's own
+// even after the key paths in it went stale, so rotate, retire and edit can refresh it.
+const sshCommandProfileKey = "gipo.profile"
+
+// SkippedRemote is a remote url that Use did not rewrite.
+type SkippedRemote struct {
+	Key    string
+	URL    string
+	Reason string
+}
+
+// Use binds the existing repository at dir to a profile: every ssh remote url and pushurl
+// on one of the profile's hosts is rewritten to the profile's alias, and the local
+// user.name and user.email are set as Clone does. Remotes through another profile's alias
+// are moved to this profile, so Use also switches a repository between profiles.
+// Only the host of a url changes; its user, port and path are kept as written. Remotes
+// that aren't ssh or are on a host the profile doesn't serve are left alone.
+//
+// With sshCommand the remotes get the canonical host instead of the alias and
+// core.sshCommand selects the profile's key, marked with gipo.profile; without it a
+// core.sshCommand set by gipo is removed, so Use also switches a repository between the
+// two modes.
+func Use(baseDir, profileName, dir string, sshCommand bool) (*UseResult, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	top, err := repoTopLevel(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := meta[profileName]
+	if !ok {
+		return nil, fmt.Errorf("profile '%s' not found", profileName)
+	}
+	if len(profile.Hosts) == 0 {
+		return nil, fmt.Errorf("profile '%s' has no host defined", profileName)
+	}
+
+	// the hosts behind the aliases of every profile, to switch remotes between profiles
+	aliasHosts := map[string]string{}
+	for _, p := range meta {
+		for _, h := range p.Hosts {
+			aliasHosts[p.alias(settings.AliasTemplate, h)] = h
+		}
+	}
+
+	remotes, err := remoteURLs(top)
+	if err != nil {
+		return nil, err
+	}
+	res := &UseResult{Dir: top}
+	for _, r := range remotes {
+		ref, err := parseRepoRef(r.URL)
+		if err != nil || ref.Host == "" || !sshRemote(r.URL) {
+			res.Skipped = append(res.Skipped, SkippedRemote{Key: r.Key, URL: r.URL, Reason: "not an ssh remote"})
+			continue
+		}
+		host := ref.Host
+		if h, ok := aliasHosts[host]; ok {
+			host = h
+		}
+		if !slices.Contains(profile.Hosts, host) {
+			res.Skipped = append(res.Skipped, SkippedRemote{Key: r.Key, URL: r.URL, Reason: fmt.Sprintf("profile '%s' has no host '%s'", profileName, host)})
+			continue
+		}
+		url := replaceRemoteHost(r.URL, profile.alias(settings.AliasTemplate, host))
+		if sshCommand {
+			url = replaceRemoteHost(r.URL, host)
+		}
+		if url == r.URL {
+			continue
+		}
+		if err := setRemoteURL(top, r, url); err != nil {
+			return res, err
+		}
+		res.Remotes = append(res.Remotes, gitConfigChange{Key: r.Key, From: r.URL, To: url})
+	}
+
+	if res.Identity, err = setLocalIdentity(top, profile); err != nil {
+		return res, err
+	}
+	values := [][2]string{{"core.sshCommand", ""}, {sshCommandProfileKey, ""}}
+	if sshCommand {
+		values = [][2]string{{"core.sshCommand", profile.sshCommand()}, {sshCommandProfileKey, profileName}}
+	} else if !ownSSHCommand(meta, top) {
+		// the user's own command stays
+		values = values[1:]
+	}
+	changed, err := setLocalConfig(top, values)
+	res.Identity = append(res.Identity, changed...)
+	if err != nil {
+		return res, err
+	}
+	if res.Previous, err = recordRepo(baseDir, profileName, top); err != nil {
+		return res, fmt.Errorf("failed to record repository in profile: %w", err)
+	}
+	return res, nil
+}
+
+// localConfig returns the value of key in the local config of the repository at dir.
+func localConfig(dir, key string) string {
+	cmd := exec.Command("git", "config", "--local", "--get", key)
+	cmd.Dir = dir
+	out, _ := cmd.Output()
+	return strings.TrimSpace(string(out))
+}
+
+// ownSSHCommand reports whether the core.sshCommand of the repository at dir was written
+// by gipo: it is marked with gipo.profile, or, if set before the mark existed, it uses the
+// key of one of the profiles in meta.
+func ownSSHCommand(meta map[string]*Profile, dir string) bool {
+	if localConfig(dir, sshCommandProfileKey) != "" {
+		return true
+	}
+	command := localConfig(dir, "core.sshCommand")
+	if !strings.HasPrefix(command, "ssh ") {
+		return false
+	}
+	for _, p := range meta {
+		for _, k := range append([]string{p.Private}, previousKeyPaths(p)...) {
+			if strings.Contains(command, " -i "+shellQuote(filepath.ToSlash(k))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// refreshSSHCommands rewrites the core.sshCommand gipo set for p in its recorded
+// repositories, after a change to its keys or ssh options. Repositories that no longer
+// exist or that were bound to p through an alias are left alone.
+func refreshSSHCommands(p *Profile) error {
+	command := p.sshCommand()
+	for _, dir := range p.Repos {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+		if localConfig(dir, sshCommandProfileKey) != p.Name {
+			continue
+		}
+		if _, err := setLocalConfig(dir, [][2]string{{"core.sshCommand", command}}); err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// repoTopLevel returns the absolute top-level directory of the git repository containing dir.
+func repoTopLevel(dir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--show-toplevel")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s is not inside a git repository", dir)
+	}
+	return filepath.Abs(strings.TrimSpace(string(out)))
+}
+
+// sshRemote reports whether a remote url is reached over ssh: an scp-style address or an
+// ssh:// URL.
+func sshRemote(url string) bool {
+	scheme, _, ok := strings.Cut(url, "://")
+	if !ok {
+		return true
+	}
+	return slices.Contains([]string{"ssh", "git+ssh", "ssh+git"}, scheme)
+}
+
+// replaceRemoteHost returns the ssh remote url with its host, the host of an scp-style
+// "[user@]host:path" or of an ssh:// authority, replaced by host. Everything else,
+// including a path that git would read differently if rebuilt, stays as it is.
+func replaceRemoteHost(url, host string) string {
+	scheme, rest, ok := strings.Cut(url, "://")
+	if !ok {
+		colon := strings.Index(url, ":")
+		userHost := url[:colon]
+		if i := strings.LastIndex(userHost, "@"); i != -1 {
+			return userHost[:i+1] + host + url[colon:]
+		}
+		return host + url[colon:]
+	}
+	authority, path := rest, ""
+	if i := strings.Index(rest, "/"); i != -1 {
+		authority, path = rest[:i], rest[i:]
+	}
+	user, hostPort := "", authority
+	if i := strings.LastIndex(authority, "@"); i != -1 {
+		user, hostPort = authority[:i+1], authority[i+1:]
+	}
+	port := ""
+	if i := strings.LastIndex(hostPort, ":"); i != -1 && !strings.Contains(hostPort[i:], "]") {
+		port = hostPort[i:]
+	}
+	return scheme + "://" + user + host + port + path
+}
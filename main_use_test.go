@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/snowmerak/gipo/key"
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+func TestUse(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	d, cfg := newStore(t,
+		Profile{Name: "work", Email: "me@company.com", AuthorName: "Me At Work", Hosts: []string{"github.com"}},
+		Profile{Name: "personal", Email: "me@home.org", Hosts: []string{"github.com", "gitlab.com"}})
+
+	repo := filepath.Join(t.TempDir(), "repo")
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if out, err := exec.Command("git", "init", "-q", repo).CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v: %s", err, out)
+	}
+	git("remote", "add", "origin", "git@github.com:acme/repo.git")
+	git("config", "--add", "remote.origin.pushurl", "ssh://git@github.com/acme/repo")
+	git("remote", "add", "mirror", "git@gitlab.com:acme/repo.git")
+	git("remote", "add", "web", "https://github.com/acme/repo.git")
+	git("remote", "add", "server", "git@github.com:/srv/git/project")
+
+	res, err := Use(d, "work", repo, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Remotes) != 3 || len(res.Skipped) != 2 || len(res.Identity) != 2 || res.Previous != "" {
+		t.Fatalf("unexpected result: %#v", res)
+	}
+	if got := git("config", "remote.origin.url"); got != "git@git-work-github-com:acme/repo.git" {
+		t.Fatalf("origin url = %s", got)
+	}
+	if got := git("config", "remote.origin.pushurl"); got != "ssh://git@git-work-github-com/acme/repo" {
+		t.Fatalf("origin pushurl = %s", got)
+	}
+	// an absolute path and a path without .git are kept as written
+	if got := git("config", "remote.server.url"); got != "git@git-work-github-com:/srv/git/project" {
+		t.Fatalf("server url = %s", got)
+	}
+	if got := git("config", "remote.web.url"); got != "https://github.com/acme/repo.git" {
+		t.Fatalf("https remote changed: %s", got)
+	}
+	if got := git("config", "user.name"); got != "Me At Work" {
+		t.Fatalf("user.name = %s", got)
+	}
+
+	// running it again changes nothing
+	if res, err := Use(d, "work", repo, false); err != nil || len(res.Remotes)+len(res.Identity) != 0 {
+		t.Fatalf("expected no changes, got %#v (%v)", res, err)
+	}
+
+	// switching moves the work alias and the gitlab remote to the personal profile
+	res, err = Use(d, "personal", repo, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Previous != "work" || len(res.Remotes) != 4 || len(res.Skipped) != 1 {
+		t.Fatalf("unexpected switch result: %#v", res)
+	}
+	if got := git("config", "remote.origin.url"); got != "git@git-personal-github-com:acme/repo.git" {
+		t.Fatalf("origin url after switch = %s", got)
+	}
+	if got := git("config", "remote.mirror.url"); got != "git@git-personal-gitlab-com:acme/repo.git" {
+		t.Fatalf("mirror url after switch = %s", got)
+	}
+	if got := git("config", "user.email"); got != "me@home.org" {
+		t.Fatalf("user.email after switch = %s", got)
+	}
+	// the ssh command mode keeps canonical URLs and selects the key in the repository
+	if res, err = Use(d, "personal", repo, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := git("config", "remote.origin.url"); got != "git@github.com:acme/repo.git" {
+		t.Fatalf("origin url in ssh command mode = %s", got)
+	}
+	if got := git("config", "remote.mirror.url"); got != "git@gitlab.com:acme/repo.git" {
+		t.Fatalf("mirror url in ssh command mode = %s", got)
+	}
+	if got := git("config", "remote.server.url"); got != "git@github.com:/srv/git/project" {
+		t.Fatalf("server url in ssh command mode = %s", got)
+	}
+	meta, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := git("config", "core.sshCommand"); got != meta["personal"].sshCommand() || git("config", "gipo.profile") != "personal" {
+		t.Fatalf("core.sshCommand = %s", got)
+	}
+	// the command follows the profile's key and ssh options
+	if _, err := Rotate(d, cfg, "personal", key.P256, true, key.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Retire(d, cfg, "personal"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := Edit(d, "personal", ProfileEdit{SetSSHOptions: []sshconfig.Option{{Key: "Port", Value: "2222"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err = LoadProfiles(d); err != nil {
+		t.Fatal(err)
+	}
+	want := meta["personal"].sshCommand()
+	if got := git("config", "core.sshCommand"); got != want || !strings.Contains(got, "personal_id_p256") || !strings.Contains(got, "Port=2222") {
+		t.Fatalf("core.sshCommand not refreshed: %s, want %s", got, want)
+	}
+	// and back to aliases, which drops gipo's ssh command but not the user's own
+	if res, err = Use(d, "personal", repo, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := git("config", "remote.origin.url"); got != "git@git-personal-github-com:acme/repo.git" {
+		t.Fatalf("origin url back in alias mode = %s", got)
+	}
+	for _, k := range []string{"core.sshCommand", "gipo.profile"} {
+		if out, err := exec.Command("git", "-C", repo, "config", k).Output(); err == nil {
+			t.Fatalf("%s left behind: %s", k, out)
+		}
+	}
+	git("config", "core.sshCommand", "ssh -v")
+	if _, err = Use(d, "personal", repo, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := git("config", "core.sshCommand"); got != "ssh -v" {
+		t.Fatalf("user's core.sshCommand changed: %s", got)
+	}
+
+	meta, err = LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta["work"].Repos) != 0 || !slices.Contains(meta["personal"].Repos, res.Dir) {
+		t.Fatalf("repository not moved between profiles: work %v, personal %v", meta["work"].Repos, meta["personal"].Repos)
+	}
+}
+
+func TestReplaceRemoteHost(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"git@github.com:acme/repo.git", "git@alias:acme/repo.git"},
+		{"git@server:/srv/git/project", "git@alias:/srv/git/project"},
+		{"server:~/project", "alias:~/project"},
+		{"ssh://git@github.com/acme/repo", "ssh://git@alias/acme/repo"},
+		{"ssh://org-1@git.example.com:2222/srv/repo.git", "ssh://org-1@alias:2222/srv/repo.git"},
+		{"git+ssh://[::1]:22/repo", "git+ssh://alias:22/repo"},
+	}
+	for _, tt := range tests {
+		if got := replaceRemoteHost(tt.in, "alias"); got != tt.want {
+			t.Errorf("replaceRemoteHost(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
@@ -1,40 +1,350 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/snowmerak/gipo/fsutil"
+	"github.com/snowmerak/gipo/sshconfig"
 )
 
+// profileSchemaVersion is the version of the keys.json layout written by SaveProfiles.
+// Version 0 is the legacy flat format: {"<name>": {"algo": "...", "private": "...", ...}}.
+// Version 1 stored a single "host" per profile; version 2 replaced it with "hosts".
+const profileSchemaVersion = 2
+
+// Profile describes a single git identity stored in keys.json.
+type Profile struct {
+	// Name is the profile name. It is the key in keys.json and is not stored in the object itself.
+	Name    string    `json:"-"`
+	Algo    string    `json:"algo"`
+	Private string    `json:"private"`
+	Public  string    `json:"public"`
+	Email   string    `json:"email"`
+	Hosts   []string  `json:"hosts,omitempty"`
+	Created time.Time `json:"created,omitzero"`
+	// AuthorName is the git user.name for commits made with this profile.
+	AuthorName string `json:"author_name,omitempty"`
+	// DisplayName is an optional human friendly label shown by list.
+	DisplayName string `json:"display_name,omitempty"`
+	// AliasTemplate overrides the alias.template setting for this profile's ssh aliases.
+	AliasTemplate string `json:"alias_template,omitempty"`
+	// Encrypted reports whether the private key is protected by a passphrase.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// KeyRef marks Private/Public as absolute paths to keys outside baseDir that were
+	// imported by reference. gipo never moves or deletes referenced keys.
+	KeyRef bool `json:"key_ref,omitempty"`
+	// PreviousKeys are rotated keys kept as extra IdentityFiles until they are retired.
+	PreviousKeys []PreviousKey `json:"previous_keys,omitempty"`
+	// SSHOptions are extra directives for the profile's ssh config blocks (e.g. Port, ProxyJump), in order.
+	SSHOptions []sshconfig.Option `json:"ssh_options,omitempty"`
+	// Dirs are directories whose repositories get this profile's identity through an
+	// includeIf section in the global git config, in the form written after "gitdir:".
+	Dirs []string `json:"dirs,omitempty"`
+	// Repos lists the absolute paths of repositories cloned with or bound to this profile.
+	Repos []string `json:"repos,omitempty"`
+}
+
+// PreviousKey is a key pair replaced by rotate that is still accepted during a grace period.
+type PreviousKey struct {
+	Algo    string    `json:"algo"`
+	Private string    `json:"private"`
+	Public  string    `json:"public"`
+	Rotated time.Time `json:"rotated,omitzero"`
+	KeyRef  bool      `json:"key_ref,omitempty"`
+}
+
+// gitUserName returns the user.name to configure for the profile.
+// Profiles created before author names existed fall back to the profile name;
+// fallback reports whether that happened.
+func (p *Profile) gitUserName() (name string, fallback bool) {
+	if p.AuthorName != "" {
+		return p.AuthorName, false
+	}
+	return p.Name, true
+}
+
+// sshCommand returns the core.sshCommand that connects with the profile's keys without an
+// ssh config entry: the current key and the keys in their rotation grace period, with
+// IdentitiesOnly and the profile's ssh options.
+func (p *Profile) sshCommand() string {
+	args := []string{"ssh"}
+	for _, k := range append([]string{p.Private}, previousKeyPaths(p)...) {
+		args = append(args, "-i", shellQuote(filepath.ToSlash(k)))
+	}
+	if !slices.ContainsFunc(p.SSHOptions, func(o sshconfig.Option) bool { return strings.EqualFold(o.Key, "IdentitiesOnly") }) {
+		args = append(args, "-o", "IdentitiesOnly=yes")
+	}
+	for _, o := range p.SSHOptions {
+		args = append(args, "-o", shellQuote(o.Key+"="+o.Value))
+	}
+	return strings.Join(args, " ")
+}
+
+// previousKeyPaths returns the private keys of p kept by a --grace rotation.
+func previousKeyPaths(p *Profile) []string {
+	var out []string
+	for _, k := range p.PreviousKeys {
+		out = append(out, k.Private)
+	}
+	return out
+}
+
+// shellQuote quotes s for the POSIX shell git runs core.sshCommand with.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// defaultAliasTemplate is the alias template used when neither the profile nor the
+// alias.template setting defines one.
+const defaultAliasTemplate = "git-{profile}-{host_dashed}"
+
+// aliasPlaceholders are the placeholders an alias template may use.
+var aliasPlaceholders = []string{"{profile}", "{host}", "{host_dashed}", "{host_short}"}
+
+// renderAlias expands an alias template for the profile name on host:
+// {profile} is the profile name, {host} the host as written (github.com),
+// {host_dashed} the host with dots replaced by dashes (github-com) and
+// {host_short} its first label (github).
+func renderAlias(tmpl, name, host string) string {
+	short, _, _ := strings.Cut(host, ".")
+	return strings.NewReplacer(
+		"{profile}", name,
+		"{host}", host,
+		"{host_dashed}", strings.ReplaceAll(host, ".", "-"),
+		"{host_short}", short,
+	).Replace(tmpl)
+}
+
+// validateAliasTemplate checks that tmpl only uses known placeholders and renders to a
+// name usable as an ssh Host alias.
+func validateAliasTemplate(tmpl string) error {
+	rest := tmpl
+	for _, ph := range aliasPlaceholders {
+		rest = strings.ReplaceAll(rest, ph, "x")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("alias template %q has an unknown placeholder (known: %s)", tmpl, strings.Join(aliasPlaceholders, ", "))
+	}
+	if rest == "" || strings.ContainsAny(rest, " \t\"'#*?!,=") {
+		return fmt.Errorf("alias template %q does not produce a valid ssh Host alias", tmpl)
+	}
+	return nil
+}
+
+// aliasTemplate returns the template the profile's aliases are built from: its own
+// template, else global (the alias.template setting), else defaultAliasTemplate.
+func (p *Profile) aliasTemplate(global string) string {
+	switch {
+	case p.AliasTemplate != "":
+		return p.AliasTemplate
+	case global != "":
+		return global
+	}
+	return defaultAliasTemplate
+}
+
+// alias returns the ssh config Host alias used for the profile on host.
+func (p *Profile) alias(global, host string) string {
+	return renderAlias(p.aliasTemplate(global), p.Name, host)
+}
+
+// aliases returns the ssh aliases of the profile, one per host, in host order.
+// global is the alias.template setting.
+func (p *Profile) aliases(global string) []string {
+	out := make([]string, 0, len(p.Hosts))
+	for _, h := range p.Hosts {
+		out = append(out, p.alias(global, h))
+	}
+	return out
+}
+
+// resolveHost picks the host to use from the profile's hosts.
+// An explicit host must be one of the profile's hosts; otherwise the profile must have exactly one.
+func (p *Profile) resolveHost(host string) (string, error) {
+	if host != "" {
+		if !slices.Contains(p.Hosts, host) {
+			return "", fmt.Errorf("profile '%s' has no host '%s' (hosts: %s)", p.Name, host, strings.Join(p.Hosts, ", "))
+		}
+		return host, nil
+	}
+	switch len(p.Hosts) {
+	case 0:
+		return "", fmt.Errorf("profile '%s' has no host defined", p.Name)
+	case 1:
+		return p.Hosts[0], nil
+	}
+	return "", fmt.Errorf("profile '%s' has several hosts (%s); choose one with --host", p.Name, strings.Join(p.Hosts, ", "))
+}
+
+// profileStore is the on-disk layout of keys.json.
+type profileStore struct {
+	Version  int                 `json:"version"`
+	Profiles map[string]*Profile `json:"profiles"`
+}
+
 // LoadProfiles reads and parses keys.json from the baseDir using the Profile struct.
+// Legacy (unversioned) files are migrated in memory; they are rewritten on the next SaveProfiles.
 // It normalizes the file paths for private/public keys to match the current OS execution environment.
 // This ensures that backups restored from Linux to Windows (or vice versa) work correctly.
-func LoadProfiles(baseDir string) (map[string]map[string]string, error) {
+func LoadProfiles(baseDir string) (map[string]*Profile, error) {
 	metaPath := filepath.Join(baseDir, "meta", "keys.json")
 	metaBytes, err := os.ReadFile(metaPath)
 	if err != nil {
 		return nil, err
 	}
 
-	var meta map[string]map[string]string
-	if err := json.Unmarshal(metaBytes, &meta); err != nil {
+	profiles, err := decodeProfiles(metaBytes)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse keys.json: %w", err)
 	}
 
 	// Normalize paths for the current environment
-	for name, info := range meta {
-		if priv, ok := info["private"]; ok && priv != "" {
-			info["private"] = fixKeyPath(baseDir, priv)
+	for name, p := range profiles {
+		p.Name = name
+		p.Private = loadKeyPath(baseDir, p.Private, p.KeyRef)
+		p.Public = loadKeyPath(baseDir, p.Public, p.KeyRef)
+		for i, k := range p.PreviousKeys {
+			p.PreviousKeys[i].Private = loadKeyPath(baseDir, k.Private, k.KeyRef)
+			p.PreviousKeys[i].Public = loadKeyPath(baseDir, k.Public, k.KeyRef)
+		}
+	}
+
+	return profiles, nil
+}
+
+// decodeProfiles parses both the versioned and the legacy flat keys.json layouts.
+func decodeProfiles(b []byte) (map[string]*Profile, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+
+	// A versioned file has a numeric "version" field. In the legacy layout every
+	// top-level value is an object, so a profile named "version" can't be mistaken for it.
+	if v, ok := raw["version"]; ok && len(bytes.TrimSpace(v)) > 0 && bytes.TrimSpace(v)[0] != '{' {
+		var store profileStore
+		if err := json.Unmarshal(b, &store); err != nil {
+			return nil, err
+		}
+		if store.Version > profileSchemaVersion {
+			return nil, fmt.Errorf("unsupported keys.json version %d (max %d)", store.Version, profileSchemaVersion)
+		}
+		if store.Profiles == nil {
+			store.Profiles = make(map[string]*Profile)
+		}
+		for name, p := range store.Profiles {
+			if p == nil {
+				store.Profiles[name] = &Profile{}
+			}
+		}
+		if store.Version < 2 {
+			// version 1 had a single "host" string
+			var v1 struct {
+				Profiles map[string]struct {
+					Host string `json:"host"`
+				} `json:"profiles"`
+			}
+			if err := json.Unmarshal(b, &v1); err != nil {
+				return nil, err
+			}
+			for name, old := range v1.Profiles {
+				if old.Host != "" {
+					store.Profiles[name].Hosts = []string{old.Host}
+				}
+			}
+		}
+		return store.Profiles, nil
+	}
+
+	return migrateLegacyProfiles(raw)
+}
+
+// migrateLegacyProfiles converts the version 0 layout (a map of string maps) into profiles.
+func migrateLegacyProfiles(raw map[string]json.RawMessage) (map[string]*Profile, error) {
+	profiles := make(map[string]*Profile, len(raw))
+	for name, msg := range raw {
+		var info map[string]string
+		if err := json.Unmarshal(msg, &info); err != nil {
+			return nil, fmt.Errorf("profile '%s': %w", name, err)
+		}
+		p := &Profile{
+			Algo:    info["algo"],
+			Private: info["private"],
+			Public:  info["public"],
+			Email:   info["email"],
 		}
-		if pub, ok := info["public"]; ok && pub != "" {
-			info["public"] = fixKeyPath(baseDir, pub)
+		if h := info["host"]; h != "" {
+			p.Hosts = []string{h}
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+// SaveProfiles writes profiles to keys.json in the current schema version.
+// Key paths are stored relative to baseDir ("keys/<file>") with forward slashes,
+// so the file stays portable across operating systems.
+func SaveProfiles(baseDir string, profiles map[string]*Profile) error {
+	store := profileStore{
+		Version:  profileSchemaVersion,
+		Profiles: make(map[string]*Profile, len(profiles)),
+	}
+	for name, p := range profiles {
+		cp := *p
+		cp.Private = storeKeyPath(cp.Private, cp.KeyRef)
+		cp.Public = storeKeyPath(cp.Public, cp.KeyRef)
+		cp.PreviousKeys = slices.Clone(cp.PreviousKeys)
+		for i, k := range cp.PreviousKeys {
+			cp.PreviousKeys[i].Private = storeKeyPath(k.Private, k.KeyRef)
+			cp.PreviousKeys[i].Public = storeKeyPath(k.Public, k.KeyRef)
 		}
-		meta[name] = info
+		store.Profiles[name] = &cp
+	}
+
+	out, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	metaPath := filepath.Join(baseDir, "meta", "keys.json")
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0o700); err != nil {
+		return err
+	}
+	return fsutil.WriteFile(metaPath, out, 0o600)
+}
+
+// lockProfiles takes the advisory lock guarding keys.json. Commands that load, modify and
+// save profiles hold it for the whole sequence so parallel invocations don't lose updates.
+func lockProfiles(baseDir string) (*fsutil.Lock, error) {
+	return fsutil.Acquire(filepath.Join(baseDir, "meta", "keys.json"))
+}
+
+// storeKeyPath returns the storage form of a key path. Keys managed by gipo are stored as
+// "keys/<file>"; referenced keys (ref) keep their absolute path.
+func storeKeyPath(p string, ref bool) string {
+	if p == "" || ref {
+		return p
 	}
+	// On Windows Join uses backslash. To be cross-platform friendly in JSON, we convert to slashes.
+	return path.Join("keys", path.Base(filepath.ToSlash(p)))
+}
 
-	return meta, nil
+// loadKeyPath is the inverse of storeKeyPath.
+func loadKeyPath(baseDir, p string, ref bool) string {
+	if p == "" || ref {
+		return p
+	}
+	return fixKeyPath(baseDir, p)
 }
 
 // fixKeyPath takes a potentially foreign path (e.g. from Linux json on Windows)
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+func TestLoadProfilesMigratesLegacy(t *testing.T) {
+	d := t.TempDir()
+	metaDir := filepath.Join(d, "meta")
+	os.MkdirAll(metaDir, 0o700)
+
+	legacy := `{
+  "work": {
+    "algo": "ed25519",
+    "private": "keys/work_id_ed25519",
+    "public": "keys/work_id_ed25519.pub",
+    "email": "me@company.com",
+    "host": "github.com"
+  }
+}`
+	if err := os.WriteFile(filepath.Join(metaDir, "keys.json"), []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, ok := profiles["work"]
+	if !ok {
+		t.Fatalf("work profile not loaded: %#v", profiles)
+	}
+	if p.Name != "work" || p.Algo != "ed25519" || p.Email != "me@company.com" || !slices.Equal(p.Hosts, []string{"github.com"}) {
+		t.Fatalf("unexpected profile: %#v", p)
+	}
+	if p.Private != filepath.Join(d, "keys", "work_id_ed25519") {
+		t.Fatalf("private path not normalized: %s", p.Private)
+	}
+
+	// saving writes the versioned layout with relative key paths
+	if err := SaveProfiles(d, profiles); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(metaDir, "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var store profileStore
+	if err := json.Unmarshal(b, &store); err != nil {
+		t.Fatal(err)
+	}
+	if store.Version != profileSchemaVersion {
+		t.Fatalf("expected version %d, got %d", profileSchemaVersion, store.Version)
+	}
+	if got := store.Profiles["work"].Private; got != "keys/work_id_ed25519" {
+		t.Fatalf("expected relative private path, got %s", got)
+	}
+
+	// and the migrated file loads back identically
+	again, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again["work"], p) {
+		t.Fatalf("round trip mismatch: %#v != %#v", again["work"], p)
+	}
+}
+
+func TestLoadProfilesRejectsNewerVersion(t *testing.T) {
+	d := t.TempDir()
+	metaDir := filepath.Join(d, "meta")
+	os.MkdirAll(metaDir, 0o700)
+	if err := os.WriteFile(filepath.Join(metaDir, "keys.json"), []byte(`{"version": 99, "profiles": {}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadProfiles(d); err == nil {
+		t.Fatal("expected error for unsupported version")
+	}
+}
+
+func TestGitUserName(t *testing.T) {
+	p := &Profile{Name: "work"}
+	if name, fallback := p.gitUserName(); name != "work" || !fallback {
+		t.Fatalf("expected fallback to profile name, got %q (fallback=%v)", name, fallback)
+	}
+	p.AuthorName = "Jane Doe"
+	if name, fallback := p.gitUserName(); name != "Jane Doe" || fallback {
+		t.Fatalf("expected author name, got %q (fallback=%v)", name, fallback)
+	}
+}
+
+func TestLoadProfilesMigratesSingleHost(t *testing.T) {
+	d := t.TempDir()
+	metaDir := filepath.Join(d, "meta")
+	os.MkdirAll(metaDir, 0o700)
+	v1 := `{"version": 1, "profiles": {"work": {"algo": "ed25519", "private": "keys/work", "public": "keys/work.pub", "email": "me@company.com", "host": "github.com"}}}`
+	if err := os.WriteFile(filepath.Join(metaDir, "keys.json"), []byte(v1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := LoadProfiles(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := profiles["work"].Hosts; !slices.Equal(got, []string{"github.com"}) {
+		t.Fatalf("expected host migrated to hosts, got %v", got)
+	}
+}
+
+func TestResolveHost(t *testing.T) {
+	p := &Profile{Name: "work", Hosts: []string{"github.com", "gitlab.example.com"}}
+	if _, err := p.resolveHost(""); err == nil {
+		t.Fatal("expected error when several hosts and none chosen")
+	}
+	if h, err := p.resolveHost("gitlab.example.com"); err != nil || h != "gitlab.example.com" {
+		t.Fatalf("unexpected result: %s, %v", h, err)
+	}
+	if _, err := p.resolveHost("bitbucket.org"); err == nil {
+		t.Fatal("expected error for unknown host")
+	}
+	want := []string{"git-work-github-com", "git-work-gitlab-example-com"}
+	if got := p.aliases(""); !slices.Equal(got, want) {
+		t.Fatalf("aliases: got %v, want %v", got, want)
+	}
+
+	single := &Profile{Name: "me", Hosts: []string{"github.com"}}
+	if h, err := single.resolveHost(""); err != nil || h != "github.com" {
+		t.Fatalf("unexpected result: %s, %v", h, err)
+	}
+}
+
+func TestAliasTemplate(t *testing.T) {
+	p := &Profile{Name: "work", Hosts: []string{"github.com", "gitlab.example.com"}}
+	if got := p.aliases("{host}-{profile}"); !slices.Equal(got, []string{"github.com-work", "gitlab.example.com-work"}) {
+		t.Fatalf("global template: got %v", got)
+	}
+	p.AliasTemplate = "{profile}.{host_short}"
+	if got := p.aliases("{host}-{profile}"); !slices.Equal(got, []string{"work.github", "work.gitlab"}) {
+		t.Fatalf("profile template: got %v", got)
+	}
+
+	for _, tmpl := range []string{"work.github", "{profile}-{host_dashed}", "gh"} {
+		if err := validateAliasTemplate(tmpl); err != nil {
+			t.Errorf("validateAliasTemplate(%q): %v", tmpl, err)
+		}
+	}
+	for _, tmpl := range []string{"", "{name}-{host}", "git {profile}", "{profile}-*"} {
+		if err := validateAliasTemplate(tmpl); err == nil {
+			t.Errorf("validateAliasTemplate(%q): expected error", tmpl)
+		}
+	}
+}
+
+func TestSSHCommand(t *testing.T) {
+	p := &Profile{Name: "work", Private: "/keys/work_id_ed25519"}
+	if got := p.sshCommand(); got != "ssh -i /keys/work_id_ed25519 -o IdentitiesOnly=yes" {
+		t.Fatalf("plain: got %s", got)
+	}
+
+	p.Private = "/home/Jo Doe/keys/it's"
+	p.PreviousKeys = []PreviousKey{{Private: "/keys/old"}}
+	p.SSHOptions = []sshconfig.Option{{Key: "IdentitiesOnly", Value: "no"}, {Key: "ProxyJump", Value: "bastion"}}
+	want := `ssh -i '/home/Jo Doe/keys/it'\''s' -i /keys/old -o IdentitiesOnly=no -o ProxyJump=bastion`
+	if got := p.sshCommand(); got != want {
+		t.Fatalf("got %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/snowmerak/gipo/fsutil"
+	"github.com/snowmerak/gipo/sshconfig"
+)
+
+// Settings are options that apply to the whole profile store. They are kept in
+// meta/settings.json; a missing file means every option has its default.
+type Settings struct {
+	// SSHInclude is the file the managed ssh entries are written to. When set, the ssh
+	// config itself only gets an Include line for it; when empty, entries are written inline.
+	SSHInclude string `json:"ssh_include,omitempty"`
+	// AliasTemplate is the template for ssh aliases of profiles without their own
+	// (see renderAlias); empty means defaultAliasTemplate.
+	AliasTemplate string `json:"alias_template,omitempty"`
+	// SnapshotKeep is the number of ssh config snapshots kept by sync; nil means
+	// defaultSnapshotKeep and 0 turns snapshots off.
+	SnapshotKeep *int `json:"snapshot_keep,omitempty"`
+}
+
+// snapshotKeep returns the configured snapshot retention.
+func (s *Settings) snapshotKeep() int {
+	if s.SnapshotKeep == nil {
+		return defaultSnapshotKeep
+	}
+	return *s.SnapshotKeep
+}
+
+// settingKey is a setting that can be read and changed with `gipo config`.
+type settingKey struct {
+	desc string
+	get  func(*Settings) string
+	set  func(*Settings, string) error
+}
+
+// settingKeys lists the settings known to `gipo config`, by name.
+var settingKeys = map[string]settingKey{
+	"alias.template": {
+		desc: "template for ssh aliases: {profile}, {host}, {host_dashed}, {host_short} (default " + defaultAliasTemplate + ")",
+		get:  func(s *Settings) string { return s.AliasTemplate },
+		set: func(s *Settings, v string) error {
+			if v != "" {
+				if err := validateAliasTemplate(v); err != nil {
+					return err
+				}
+				if !strings.Contains(v, "{profile}") {
+					return fmt.Errorf("alias template %q must contain {profile} so profiles get distinct aliases", v)
+				}
+			}
+			s.AliasTemplate = v
+			return nil
+		},
+	},
+	"snapshot.keep": {
+		desc: fmt.Sprintf("number of ssh config snapshots kept by sync, 0 disables them (default %d)", defaultSnapshotKeep),
+		get: func(s *Settings) string {
+			if s.SnapshotKeep == nil {
+				return ""
+			}
+			return strconv.Itoa(*s.SnapshotKeep)
+		},
+		set: func(s *Settings, v string) error {
+			if v == "" {
+				s.SnapshotKeep = nil
+				return nil
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%q is not a number of snapshots", v)
+			}
+			s.SnapshotKeep = &n
+			return nil
+		},
+	},
+	"ssh.include": {
+		desc: "file for managed ssh entries, included from the ssh config (empty: write entries inline)",
+		get:  func(s *Settings) string { return s.SSHInclude },
+		set: func(s *Settings, v string) error {
+			s.SSHInclude = v
+			return nil
+		},
+	},
+}
+
+// LoadSettings reads meta/settings.json from baseDir.
+func LoadSettings(baseDir string) (*Settings, error) {
+	b, err := os.ReadFile(filepath.Join(baseDir, "meta", "settings.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Settings{}, nil
+		}
+		return nil, err
+	}
+	var s Settings
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse settings.json: %w", err)
+	}
+	return &s, nil
+}
+
+// SaveSettings writes s to meta/settings.json in baseDir.
+func SaveSettings(baseDir string, s *Settings) error {
+	out, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(baseDir, "meta", "settings.json")
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return fsutil.WriteFile(path, out, 0o600)
+}
+
+// SetSetting changes the setting key to value. An empty value restores the default.
+func SetSetting(baseDir, key, value string) error {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		baseDir = filepath.Join(home, ".ssh", "git_profiles")
+	}
+
+	k, ok := settingKeys[key]
+	if !ok {
+		return fmt.Errorf("unknown setting '%s' (known: %s)", key, strings.Join(settingNames(), ", "))
+	}
+
+	lock, err := lockProfiles(baseDir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	s, err := LoadSettings(baseDir)
+	if err != nil {
+		return err
+	}
+	if err := k.set(s, value); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return SaveSettings(baseDir, s)
+}
+
+// settingNames returns the known setting names in sorted order.
+func settingNames() []string {
+	names := make([]string, 0, len(settingKeys))
+	for name := range settingKeys {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// managedSSHConfig returns the file holding the managed ssh entries: the configured include
+// file, or cfgPath itself when entries are written inline. A relative include path is
+// resolved against the directory of cfgPath, as ssh does for Include.
+func managedSSHConfig(baseDir, cfgPath string) (string, error) {
+	s, err := LoadSettings(baseDir)
+	if err != nil {
+		return "", err
+	}
+	if s.SSHInclude == "" {
+		return cfgPath, nil
+	}
+	p := expandHome(s.SSHInclude)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(filepath.Dir(cfgPath), p)
+	}
+	return p, nil
+}
+
+// sshConfigFiles returns the files that may hold managed entries: the managed file and,
+// in include mode, the main config with blocks not migrated yet.
+func sshConfigFiles(baseDir, cfgPath string) ([]string, error) {
+	managed, err := managedSSHConfig(baseDir, cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	if managed == cfgPath {
+		return []string{cfgPath}, nil
+	}
+	return []string{managed, cfgPath}, nil
+}
+
+// storeOwner returns the owner id written into the managed blocks of the profile store at
+// baseDir: a short hash of its absolute path, so stores sharing an ssh config keep apart.
+// Symlinks are resolved, so the store has one id whichever path reaches it.
+func storeOwner(baseDir string) string {
+	if abs, err := filepath.Abs(baseDir); err == nil {
+		baseDir = abs
+	}
+	if real, err := filepath.EvalSymlinks(baseDir); err == nil {
+		baseDir = real
+	}
+	sum := sha256.Sum256([]byte(filepath.Clean(baseDir)))
+	return hex.EncodeToString(sum[:4])
+}
+
+// ownedBy reports whether the managed entry e belongs to the store owner. An entry from
+// before blocks had owners belongs to the store only if ours, the aliases the store
+// produces, has its alias; sync then tags it with the owner.
+func ownedBy(e sshconfig.Entry, owner string, ours []string) bool {
+	return e.Owner == owner || e.Owner == "" && slices.Contains(ours, e.Alias)
+}
+
+// storeAliases returns the ssh aliases of every profile in the store at baseDir.
+func storeAliases(baseDir string) ([]string, error) {
+	meta, err := LoadProfiles(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := LoadSettings(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, p := range meta {
+		out = append(out, p.aliases(settings.AliasTemplate)...)
+	}
+	return out, nil
+}
+
+// expandHome replaces a leading "~/" with the home directory.
+func expandHome(p string) string {
+	if rest, ok := strings.CutPrefix(filepath.ToSlash(p), "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, filepath.FromSlash(rest))
+		}
+	}
+	return p
+}
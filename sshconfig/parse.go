@@ -0,0 +1,378 @@
+package sshconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// maxIncludeDepth mirrors the recursion limit of OpenSSH's Include handling.
+const maxIncludeDepth = 16
+
+// Config is a parsed ssh config file. Every line keeps its original text, so String
+// reproduces the file byte for byte (apart from a missing final newline).
+type Config struct {
+	// Path is the file the config was read from; empty for Parse.
+	Path string
+	// Lines holds every line of the file in order, including comments and blank lines.
+	Lines []*Line
+	// Blocks holds the sections of the file in order. Blocks[0] is the global section
+	// before the first Host or Match line and has no header.
+	Blocks []*Block
+}
+
+// Line is a single line of an ssh config file.
+type Line struct {
+	// Num is the 1-based line number.
+	Num int
+	// Raw is the original text of the line without the trailing newline.
+	Raw string
+	// Keyword is the directive name as written (e.g. "HostName"); empty for comments and blank lines.
+	Keyword string
+	// Args are the directive arguments with quotes removed.
+	Args []string
+	// Included holds the files loaded by an Include directive (ParseFile only).
+	Included []*Config
+}
+
+// IsDirective reports whether the line holds a keyword rather than a comment or blank.
+func (l *Line) IsDirective() bool {
+	return l.Keyword != ""
+}
+
+// Is reports whether the line is the directive keyword, ignoring case like ssh does.
+func (l *Line) Is(keyword string) bool {
+	return strings.EqualFold(l.Keyword, keyword)
+}
+
+// Block is a Host or Match section, or the global section at the top of a file.
+type Block struct {
+	// Kind is "Host", "Match" or "" for the global section.
+	Kind string
+	// Patterns are the arguments of the Host or Match line.
+	Patterns []string
+	// Header is the Host or Match line; nil for the global section.
+	Header *Line
+	// Lines are the lines following the header up to the next section.
+	Lines []*Line
+	// Managed is the alias of the surrounding "# BEGIN GITPROFILES" marker, if any.
+	Managed string
+	// Config is the file the block was read from.
+	Config *Config
+}
+
+// MatchesHost reports whether a Host block applies to host, using ssh pattern rules:
+// "*" and "?" wildcards, "!" negation, case-insensitive. Match blocks and the global
+// section always return false.
+func (b *Block) MatchesHost(host string) bool {
+	if b.Kind != "Host" {
+		return false
+	}
+	host = strings.ToLower(host)
+	matched := false
+	for _, p := range b.Patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.ToLower(strings.TrimPrefix(p, "!"))
+		if !wildcardMatch(p, host) {
+			continue
+		}
+		if negate {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// Defines reports whether a Host block names host literally, without wildcards.
+func (b *Block) Defines(host string) bool {
+	if b.Kind != "Host" {
+		return false
+	}
+	for _, p := range b.Patterns {
+		if !strings.ContainsAny(p, "*?!") && strings.EqualFold(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the arguments of the first directive named keyword in the block.
+func (b *Block) Get(keyword string) []string {
+	for _, l := range b.Lines {
+		if l.Is(keyword) {
+			return l.Args
+		}
+	}
+	return nil
+}
+
+// AllBlocks returns the blocks of c with the blocks of included files inserted after
+// the block containing the Include directive, in the order ssh reads them.
+func (c *Config) AllBlocks() []*Block {
+	var out []*Block
+	for _, b := range c.Blocks {
+		out = append(out, b)
+		lines := b.Lines
+		if b.Header != nil {
+			lines = append([]*Line{b.Header}, lines...)
+		}
+		for _, l := range lines {
+			for _, inc := range l.Included {
+				out = append(out, inc.AllBlocks()...)
+			}
+		}
+	}
+	return out
+}
+
+// FindHost returns the Host blocks, including those from included files, that apply to host.
+func (c *Config) FindHost(host string) []*Block {
+	var out []*Block
+	for _, b := range c.AllBlocks() {
+		if b.MatchesHost(host) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// Conflict returns a *ConflictError if an unmanaged Host block, in c or an included file,
+// names alias literally. Wildcard patterns such as "Host *" are not conflicts.
+func (c *Config) Conflict(alias string) error {
+	for _, b := range c.AllBlocks() {
+		if b.Managed == "" && b.Defines(alias) {
+			return &ConflictError{Alias: alias, Path: displayPath(b.Config.Path), Line: b.Header.Num}
+		}
+	}
+	return nil
+}
+
+// Includes reports whether the global section of c, before any Host or Match line,
+// has an Include directive for path.
+func (c *Config) Includes(path string) bool {
+	for _, l := range c.Blocks[0].Lines {
+		if l.Is("Include") && slices.ContainsFunc(l.Args, func(a string) bool { return c.includeRefers(a, path) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// includeRefers reports whether the Include argument arg names path.
+func (c *Config) includeRefers(arg, path string) bool {
+	dir := "."
+	if c.Path != "" {
+		dir = filepath.Dir(c.Path)
+	}
+	return filepath.Clean(expandIncludePath(arg, dir)) == filepath.Clean(path)
+}
+
+// String renders the config back to text.
+func (c *Config) String() string {
+	var sb strings.Builder
+	for _, l := range c.Lines {
+		sb.WriteString(l.Raw)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// Parse reads an ssh config from r. Include directives are recorded but not followed.
+func Parse(r io.Reader) (*Config, error) {
+	return parse(r, "", "", 0)
+}
+
+// ParseFile reads the ssh config at path and follows its Include directives.
+// Include arguments may use globs and "~/"; relative paths are resolved against the
+// directory of path (ssh resolves them against ~/.ssh, which is the same for the user config).
+// Missing config files return an error satisfying os.IsNotExist; missing includes are ignored.
+func ParseFile(path string) (*Config, error) {
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".ssh", "config")
+	}
+	return parseFile(path, filepath.Dir(path), 0)
+}
+
+func parseFile(path, includeDir string, depth int) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f, path, includeDir, depth)
+}
+
+func parse(r io.Reader, path, includeDir string, depth int) (*Config, error) {
+	c := &Config{Path: path}
+	current := &Block{Config: c}
+	c.Blocks = append(c.Blocks, current)
+	managed := ""
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	num := 0
+	for sc.Scan() {
+		num++
+		raw := strings.TrimSuffix(sc.Text(), "\r")
+		l := &Line{Num: num, Raw: raw}
+		c.Lines = append(c.Lines, l)
+
+		trimmed := strings.TrimSpace(raw)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			if m, ok := parseBeginMarker(trimmed); ok {
+				managed = m.alias
+			} else if strings.HasPrefix(trimmed, endMarker) {
+				managed = ""
+			}
+			current.Lines = append(current.Lines, l)
+			continue
+		}
+
+		kw, args, err := splitDirective(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", displayPath(path), num, err)
+		}
+		l.Keyword, l.Args = kw, args
+
+		if l.Is("Host") || l.Is("Match") {
+			kind := "Host"
+			if l.Is("Match") {
+				kind = "Match"
+			}
+			current = &Block{Kind: kind, Patterns: args, Header: l, Managed: managed, Config: c}
+			c.Blocks = append(c.Blocks, current)
+			continue
+		}
+		current.Lines = append(current.Lines, l)
+
+		if l.Is("Include") && path != "" {
+			if depth >= maxIncludeDepth {
+				return nil, fmt.Errorf("%s:%d: too many nested includes", displayPath(path), num)
+			}
+			for _, pattern := range args {
+				matches, err := filepath.Glob(expandIncludePath(pattern, includeDir))
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", displayPath(path), num, err)
+				}
+				for _, m := range matches {
+					inc, err := parseFile(m, includeDir, depth+1)
+					if err != nil {
+						if os.IsNotExist(err) {
+							continue
+						}
+						return nil, err
+					}
+					l.Included = append(l.Included, inc)
+				}
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// splitDirective splits "Keyword args" or "Keyword=args" and unquotes the arguments.
+func splitDirective(s string) (string, []string, error) {
+	kw, rest := splitKeyword(s)
+	args, err := splitArgs(rest)
+	return kw, args, err
+}
+
+// splitKeyword splits a trimmed directive into its keyword and the raw argument text.
+func splitKeyword(s string) (kw, rest string) {
+	i := strings.IndexAny(s, " \t=")
+	if i == -1 {
+		return s, ""
+	}
+	rest = strings.TrimLeft(s[i:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+	return s[:i], strings.TrimSpace(rest)
+}
+
+// splitArgs splits whitespace separated arguments, honouring double quotes.
+func splitArgs(s string) ([]string, error) {
+	var out []string
+	var cur strings.Builder
+	inQuote, has := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			has = true
+		case (r == ' ' || r == '\t') && !inQuote:
+			if has {
+				out = append(out, cur.String())
+				cur.Reset()
+				has = false
+			}
+		default:
+			cur.WriteRune(r)
+			has = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if has {
+		out = append(out, cur.String())
+	}
+	return out, nil
+}
+
+// expandIncludePath resolves "~/" and relative Include arguments.
+func expandIncludePath(p, dir string) string {
+	p = toAbsPath(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	return p
+}
+
+// wildcardMatch matches s against an ssh pattern with "*" and "?".
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if wildcardMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func displayPath(p string) string {
+	if p == "" {
+		return "<input>"
+	}
+	return p
+}
@@ -0,0 +1,180 @@
+package sshconfig
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseBlocksAndRoundTrip(t *testing.T) {
+	src := `# global settings
+ServerAliveInterval 30
+
+Host github.com gh
+    HostName=github.com
+    IdentityFile "~/.ssh/my key"
+Match host *.corp exec "test -f /tmp/x"
+    User admin
+# BEGIN GITPROFILES git-work-github-com
+Host git-work-github-com
+    HostName github.com
+# END GITPROFILES git-work-github-com
+`
+	cfg, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.String() != src {
+		t.Fatalf("round trip mismatch:\n%s", cfg.String())
+	}
+	if len(cfg.Blocks) != 4 {
+		t.Fatalf("expected 4 blocks, got %d", len(cfg.Blocks))
+	}
+	if cfg.Blocks[0].Kind != "" || len(cfg.Blocks[0].Get("ServerAliveInterval")) != 1 {
+		t.Fatalf("unexpected global block: %+v", cfg.Blocks[0])
+	}
+	gh := cfg.Blocks[1]
+	if gh.Kind != "Host" || !slices.Equal(gh.Patterns, []string{"github.com", "gh"}) {
+		t.Fatalf("unexpected host block: %+v", gh)
+	}
+	if got := gh.Get("hostname"); !slices.Equal(got, []string{"github.com"}) {
+		t.Fatalf("HostName=value not parsed: %v", got)
+	}
+	if got := gh.Get("IdentityFile"); !slices.Equal(got, []string{"~/.ssh/my key"}) {
+		t.Fatalf("quoted argument not parsed: %v", got)
+	}
+	m := cfg.Blocks[2]
+	if m.Kind != "Match" || !slices.Equal(m.Patterns, []string{"host", "*.corp", "exec", "test -f /tmp/x"}) {
+		t.Fatalf("unexpected match block: %+v", m)
+	}
+	if cfg.Blocks[3].Managed != "git-work-github-com" || gh.Managed != "" {
+		t.Fatalf("managed markers not tracked")
+	}
+}
+
+func TestMatchesHost(t *testing.T) {
+	b := &Block{Kind: "Host", Patterns: []string{"*.example.com", "!secret.example.com", "git?"}}
+	cases := map[string]bool{
+		"a.example.com":      true,
+		"A.Example.COM":      true,
+		"secret.example.com": false,
+		"example.com":        false,
+		"git1":               true,
+		"git12":              false,
+	}
+	for host, want := range cases {
+		if got := b.MatchesHost(host); got != want {
+			t.Errorf("MatchesHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestParseFileIncludes(t *testing.T) {
+	d := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(d, "config.d", "nested"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(d, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("config", "Include config.d/*.conf missing.conf\nHost main\n    HostName main.example\n")
+	write("config.d/a.conf", "Host a\n    Include config.d/nested/*\n")
+	write("config.d/b.conf", "Host b\n")
+	write("config.d/nested/c", "Host c\n")
+
+	cfg, err := ParseFile(filepath.Join(d, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, b := range cfg.AllBlocks() {
+		if b.Kind == "Host" {
+			order = append(order, b.Patterns[0])
+		}
+	}
+	if want := []string{"a", "c", "b", "main"}; !slices.Equal(order, want) {
+		t.Fatalf("block order = %v, want %v", order, want)
+	}
+	if found := cfg.FindHost("c"); len(found) != 1 || !strings.HasSuffix(found[0].Config.Path, "c") {
+		t.Fatalf("FindHost(c) = %v", found)
+	}
+}
+
+func TestParseFileIncludeLoop(t *testing.T) {
+	d := t.TempDir()
+	cfg := filepath.Join(d, "config")
+	if err := os.WriteFile(cfg, []byte("Include config\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseFile(cfg); err == nil {
+		t.Fatal("expected error for recursive include")
+	}
+}
+
+func TestAddOrReplaceEntryConflict(t *testing.T) {
+	d := t.TempDir()
+	cfg := filepath.Join(d, "config")
+	orig := "Host *\n    ServerAliveInterval 30\n\nHost git-work-github-com\n    HostName github.com\n"
+	if err := os.WriteFile(cfg, []byte(orig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	err := AddOrReplaceEntry(cfg, Entry{Alias: "git-work-github-com", HostName: "github.com", User: "git", IdentityFile: "/k"})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || conflict.Line != 4 {
+		t.Fatalf("expected conflict on line 4, got %v", err)
+	}
+	b, _ := os.ReadFile(cfg)
+	if string(b) != orig {
+		t.Fatalf("config modified despite conflict:\n%s", b)
+	}
+
+	// a wildcard Host block is not a conflict
+	if err := AddOrReplaceEntry(cfg, Entry{Alias: "git-home-github-com", HostName: "github.com", User: "git", IdentityFile: "/k"}); err != nil {
+		t.Fatal(err)
+	}
+	// and replacing our own managed block is fine
+	if err := AddOrReplaceEntry(cfg, Entry{Alias: "git-home-github-com", HostName: "gitlab.com", User: "git", IdentityFile: "/k"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnsureInclude(t *testing.T) {
+	d := t.TempDir()
+	cfg := filepath.Join(d, "config")
+	inc := filepath.Join(d, "config.d", "gipo.conf")
+	orig := "# my config\nHost work\n    Include config.d/gipo.conf other.conf\n"
+	if err := os.WriteFile(cfg, []byte(orig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := EnsureInclude(cfg, inc)
+	if err != nil || !changed {
+		t.Fatalf("expected change, got %v %v", changed, err)
+	}
+	b, _ := os.ReadFile(cfg)
+	parsed, err := Parse(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed.Path = cfg
+	if !parsed.Includes(inc) || !strings.HasPrefix(string(b), "Include ") {
+		t.Fatalf("expected Include at the top, got:\n%s", b)
+	}
+	if !strings.Contains(string(b), "Host work\n    Include other.conf\n") {
+		t.Fatalf("expected other include kept, got:\n%s", b)
+	}
+	if strings.Count(string(b), "gipo.conf") != 1 {
+		t.Fatalf("expected a single Include for the file, got:\n%s", b)
+	}
+
+	changed, err = EnsureInclude(cfg, inc)
+	if err != nil || changed {
+		t.Fatalf("expected no change on second call, got %v %v", changed, err)
+	}
+}
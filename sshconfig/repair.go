@@ -0,0 +1,267 @@
+package sshconfig
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ProblemKind classifies damage to the managed blocks of a config.
+type ProblemKind string
+
+const (
+	// MissingEnd is a BEGIN marker without a matching END marker.
+	MissingEnd ProblemKind = "missing END marker"
+	// StrayEnd is an END marker without a BEGIN marker before it.
+	StrayEnd ProblemKind = "END marker without BEGIN"
+	// Nested is a managed block inside another managed block.
+	Nested ProblemKind = "nested in another managed block"
+	// Duplicate is a second managed block for an alias.
+	Duplicate ProblemKind = "duplicate block"
+	// HostMismatch is a managed block whose Host line doesn't name its alias.
+	HostMismatch ProblemKind = "Host line does not match the marker"
+	// OldOwner is a managed block of a profile store that moved, reported by Reown.
+	OldOwner ProblemKind = "owned by the store's old location"
+)
+
+// Problem is one damaged managed block found by Repair.
+type Problem struct {
+	Kind  ProblemKind
+	Alias string
+	// Line is the 1-based line of the marker the problem was found at.
+	Line int
+	// Fix describes what Repair does about it.
+	Fix string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("line %d: %s: %s; %s", p.Line, p.Alias, p.Kind, p.Fix)
+}
+
+// DamagedError reports damaged managed blocks in a config file. Editing such a file could
+// lose or duplicate entries, so it has to be repaired first.
+type DamagedError struct {
+	Path     string
+	Problems []Problem
+}
+
+func (e *DamagedError) Error() string {
+	p := e.Problems[0]
+	msg := fmt.Sprintf("%s:%d: managed block %s: %s", e.Path, p.Line, p.Alias, p.Kind)
+	if n := len(e.Problems) - 1; n > 0 {
+		msg += fmt.Sprintf(" (and %d more)", n)
+	}
+	return msg + "; run 'gipo sshconfig repair' to fix it"
+}
+
+// checkDamage returns a *DamagedError if content has damaged managed blocks.
+func checkDamage(path, content string) error {
+	if _, problems := Repair(content); len(problems) > 0 {
+		return &DamagedError{Path: path, Problems: problems}
+	}
+	return nil
+}
+
+// repairBlock is a managed block as found while repairing.
+type repairBlock struct {
+	marker
+	line int
+	body []string
+	// closed is set when the block has its END marker.
+	closed bool
+	// inner are blocks nested in this one; they are moved out after it.
+	inner []*repairBlock
+	// rest are lines cut from an unterminated block; they are moved out after it.
+	rest []string
+	// drop is set for duplicates that are removed.
+	drop bool
+}
+
+// repairItem is a line outside of managed blocks or a top-level block.
+type repairItem struct {
+	line  string
+	block *repairBlock
+}
+
+// Repair returns content with its managed blocks fixed, and the problems it fixed:
+//   - a block without END marker ends before the next Host or Match line, or the next marker;
+//   - END markers without a BEGIN marker are removed;
+//   - nested blocks are moved out after the block containing them;
+//   - of several blocks for one alias the first complete one is kept;
+//   - the Host line of a block is set to its alias.
+//
+// Content without problems is returned unchanged.
+func Repair(content string) (string, []Problem) {
+	trailingNewline := strings.HasSuffix(content, "\n")
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	if content == "" {
+		lines = nil
+	}
+
+	var (
+		items    []repairItem
+		stack    []*repairBlock
+		all      []*repairBlock
+		problems []Problem
+		parents  = make(map[*repairBlock]*repairBlock)
+	)
+	// unterminated ends an open block that has no END marker
+	unterminated := func(b *repairBlock) {
+		problems = append(problems, Problem{Kind: MissingEnd, Alias: b.alias, Line: b.line, Fix: "END marker added"})
+		hosts := 0
+		for i, l := range b.body {
+			kw, _ := splitKeyword(strings.TrimSpace(l))
+			if strings.EqualFold(kw, "host") || strings.EqualFold(kw, "match") {
+				if hosts++; hosts == 2 {
+					b.body, b.rest = b.body[:i], b.body[i:]
+					break
+				}
+			}
+		}
+	}
+
+	for i, raw := range lines {
+		t := strings.TrimSpace(raw)
+		if m, ok := parseBeginMarker(t); ok {
+			b := &repairBlock{marker: m, line: i + 1}
+			// a second BEGIN for the open alias means its END is missing
+			if len(stack) > 0 && stack[len(stack)-1].alias == m.alias {
+				unterminated(stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parents[b] = parent
+				parent.inner = append(parent.inner, b)
+			} else {
+				items = append(items, repairItem{block: b})
+			}
+			stack = append(stack, b)
+			all = append(all, b)
+			continue
+		}
+		if alias, ok := strings.CutPrefix(t, endMarker); ok && alias != "" {
+			k := slices.IndexFunc(stack, func(b *repairBlock) bool { return b.alias == alias })
+			if k == -1 {
+				problems = append(problems, Problem{Kind: StrayEnd, Alias: alias, Line: i + 1, Fix: "marker removed"})
+				continue
+			}
+			for len(stack)-1 > k {
+				unterminated(stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
+			stack[k].closed = true
+			stack = stack[:k]
+			continue
+		}
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			top.body = append(top.body, raw)
+		} else {
+			items = append(items, repairItem{line: raw})
+		}
+	}
+	for len(stack) > 0 {
+		unterminated(stack[len(stack)-1])
+		stack = stack[:len(stack)-1]
+	}
+
+	// a block is only nested if the one around it is complete; otherwise that one just
+	// lacks its END marker
+	for _, b := range all {
+		if p, ok := parents[b]; ok && p.closed {
+			problems = append(problems, Problem{Kind: Nested, Alias: b.alias, Line: b.line, Fix: fmt.Sprintf("moved after block %s", p.alias)})
+		}
+	}
+
+	// keep the first complete block of each alias, or the first one if none is complete
+	keep := make(map[string]*repairBlock)
+	for _, b := range all {
+		if k, ok := keep[b.alias]; !ok || (!k.closed && b.closed) {
+			keep[b.alias] = b
+		}
+	}
+	for _, b := range all {
+		if keep[b.alias] != b {
+			b.drop = true
+			problems = append(problems, Problem{Kind: Duplicate, Alias: b.alias, Line: b.line, Fix: fmt.Sprintf("removed, keeping the block at line %d", keep[b.alias].line)})
+		}
+	}
+
+	for _, b := range all {
+		if b.drop {
+			continue
+		}
+		host := slices.IndexFunc(b.body, func(l string) bool {
+			kw, _ := splitKeyword(strings.TrimSpace(l))
+			return strings.EqualFold(kw, "host")
+		})
+		if host == -1 {
+			problems = append(problems, Problem{Kind: HostMismatch, Alias: b.alias, Line: b.line, Fix: "Host line added"})
+			b.body = slices.Insert(b.body, 0, "Host "+b.alias)
+			continue
+		}
+		l := b.body[host]
+		_, rest := splitKeyword(strings.TrimSpace(l))
+		if args, err := splitArgs(rest); err != nil || len(args) != 1 || args[0] != b.alias {
+			problems = append(problems, Problem{Kind: HostMismatch, Alias: b.alias, Line: b.line, Fix: fmt.Sprintf("%q replaced by \"Host %s\"", strings.TrimSpace(l), b.alias)})
+			b.body[host] = l[:len(l)-len(strings.TrimLeft(l, " \t"))] + "Host " + b.alias
+		}
+	}
+
+	if len(problems) == 0 {
+		return content, nil
+	}
+	slices.SortStableFunc(problems, func(a, b Problem) int { return a.Line - b.Line })
+
+	var out []string
+	var emit func(b *repairBlock)
+	emit = func(b *repairBlock) {
+		if !b.drop {
+			out = append(out, b.marker.String())
+			out = append(out, b.body...)
+			out = append(out, endMarker+b.alias)
+		}
+		for _, in := range b.inner {
+			emit(in)
+		}
+		out = append(out, b.rest...)
+	}
+	for _, it := range items {
+		if it.block != nil {
+			emit(it.block)
+		} else {
+			out = append(out, it.line)
+		}
+	}
+	repaired := strings.Join(out, "\n")
+	if trailingNewline || repaired != "" {
+		repaired += "\n"
+	}
+	return repaired, problems
+}
+
+// Reown returns content with the managed blocks owned by from given to the owner to, e.g.
+// after a profile store moved and its owner id changed, and the blocks it changed. The
+// checksums only cover the lines between the markers, so they stay valid.
+func Reown(content, from, to string) (string, []Problem) {
+	lines := strings.Split(content, "\n")
+	var problems []Problem
+	for i, l := range lines {
+		m, ok := parseBeginMarker(l)
+		if !ok || m.owner != from || from == to {
+			continue
+		}
+		m.owner = to
+		problems = append(problems, Problem{Kind: OldOwner, Alias: m.alias, Line: i + 1, Fix: "owner set to " + to})
+		cr := ""
+		if strings.HasSuffix(l, "\r") {
+			cr = "\r"
+		}
+		lines[i] = m.String() + cr
+	}
+	if len(problems) == 0 {
+		return content, nil
+	}
+	return strings.Join(lines, "\n"), problems
+}
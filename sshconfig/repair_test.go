@@ -0,0 +1,117 @@
+package sshconfig
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		want  string
+		kinds []ProblemKind
+	}{
+		{
+			name: "intact",
+			in:   "Host a\n  HostName a\n\n  # BEGIN GITPROFILES x\nHost x\n# END GITPROFILES x\n",
+			want: "Host a\n  HostName a\n\n  # BEGIN GITPROFILES x\nHost x\n# END GITPROFILES x\n",
+		},
+		{
+			name:  "missing end before user host",
+			in:    "# BEGIN GITPROFILES x\nHost x\n    HostName h\n\nHost mine\n    User me\n",
+			want:  "# BEGIN GITPROFILES x\nHost x\n    HostName h\n\n# END GITPROFILES x\nHost mine\n    User me\n",
+			kinds: []ProblemKind{MissingEnd},
+		},
+		{
+			name:  "missing end followed by appended block",
+			in:    "# BEGIN GITPROFILES x\nHost x\n    HostName old\n# BEGIN GITPROFILES x\nHost x\n    HostName new\n# END GITPROFILES x\n",
+			want:  "# BEGIN GITPROFILES x\nHost x\n    HostName new\n# END GITPROFILES x\n",
+			kinds: []ProblemKind{MissingEnd, Duplicate},
+		},
+		{
+			name:  "duplicate",
+			in:    "# BEGIN GITPROFILES x\nHost x\n# END GITPROFILES x\nHost y\n# BEGIN GITPROFILES x\nHost x\n    Port 1\n# END GITPROFILES x\n",
+			want:  "# BEGIN GITPROFILES x\nHost x\n# END GITPROFILES x\nHost y\n",
+			kinds: []ProblemKind{Duplicate},
+		},
+		{
+			name:  "nested",
+			in:    "# BEGIN GITPROFILES x\nHost x\n# BEGIN GITPROFILES y\nHost y\n# END GITPROFILES y\n    Port 1\n# END GITPROFILES x\n",
+			want:  "# BEGIN GITPROFILES x\nHost x\n    Port 1\n# END GITPROFILES x\n# BEGIN GITPROFILES y\nHost y\n# END GITPROFILES y\n",
+			kinds: []ProblemKind{Nested},
+		},
+		{
+			name:  "stray end",
+			in:    "Host a\n# END GITPROFILES x\n",
+			want:  "Host a\n",
+			kinds: []ProblemKind{StrayEnd},
+		},
+		{
+			name:  "host mismatch",
+			in:    "# BEGIN GITPROFILES x\n  Host x other\n    HostName h\n# END GITPROFILES x\n# BEGIN GITPROFILES y\n    HostName h\n# END GITPROFILES y\n",
+			want:  "# BEGIN GITPROFILES x\n  Host x\n    HostName h\n# END GITPROFILES x\n# BEGIN GITPROFILES y\nHost y\n    HostName h\n# END GITPROFILES y\n",
+			kinds: []ProblemKind{HostMismatch, HostMismatch},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, problems := Repair(tt.in)
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+			var kinds []ProblemKind
+			for _, p := range problems {
+				kinds = append(kinds, p.Kind)
+			}
+			if len(kinds) != len(tt.kinds) {
+				t.Fatalf("problems = %v, want kinds %v", problems, tt.kinds)
+			}
+			for i := range kinds {
+				if kinds[i] != tt.kinds[i] {
+					t.Fatalf("problems = %v, want kinds %v", problems, tt.kinds)
+				}
+			}
+			// a repaired config needs no further repair
+			if again, problems := Repair(got); again != got || len(problems) != 0 {
+				t.Errorf("repair is not idempotent: %v\n%s", problems, again)
+			}
+		})
+	}
+}
+
+func TestEditRefusesDamagedConfig(t *testing.T) {
+	cfg := filepath.Join(t.TempDir(), "config")
+	damaged := "# BEGIN GITPROFILES x\nHost x\n    HostName h\n"
+	os.WriteFile(cfg, []byte(damaged), 0o600)
+
+	var de *DamagedError
+	if err := AddOrReplaceEntry(cfg, Entry{Alias: "x", HostName: "h2"}); !errors.As(err, &de) || de.Problems[0].Kind != MissingEnd {
+		t.Fatalf("expected DamagedError from AddOrReplaceEntry, got %v", err)
+	}
+	if err := RemoveEntry(cfg, "x"); !errors.As(err, &de) {
+		t.Fatalf("expected DamagedError from RemoveEntry, got %v", err)
+	}
+	if _, err := ListEntries(cfg); !errors.As(err, &de) {
+		t.Fatalf("expected DamagedError from ListEntries, got %v", err)
+	}
+	if b, _ := os.ReadFile(cfg); string(b) != damaged {
+		t.Fatalf("damaged config was modified:\n%s", b)
+	}
+}
+
+func TestReown(t *testing.T) {
+	in := "# BEGIN GITPROFILES a owner=old sum=1234\r\nHost a\r\n# END GITPROFILES a\r\n" +
+		"# BEGIN GITPROFILES b owner=other\nHost b\n# END GITPROFILES b\n"
+	got, problems := Reown(in, "old", "new")
+	want := strings.Replace(in, "owner=old", "owner=new", 1)
+	if got != want || len(problems) != 1 || problems[0].Alias != "a" || problems[0].Kind != OldOwner {
+		t.Fatalf("Reown = %q, %v", got, problems)
+	}
+	if got, problems := Reown(in, "gone", "new"); got != in || problems != nil {
+		t.Fatalf("expected no change, got %q, %v", got, problems)
+	}
+}
@@ -1,18 +1,150 @@
 package sshconfig
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"unicode"
+
+	"github.com/snowmerak/gipo/fsutil"
+)
+
+// Markers delimiting the blocks managed by gipo; the alias follows the marker. The BEGIN
+// marker may also carry "owner=<id>", the profile store the block belongs to, and
+// "sum=<hash>", a checksum of the lines gipo wrote between the markers.
+const (
+	beginMarker = "# BEGIN GITPROFILES "
+	endMarker   = "# END GITPROFILES "
+	ownerPrefix = "owner="
+	sumPrefix   = "sum="
 )
 
+// marker is a parsed BEGIN marker.
+type marker struct {
+	alias, owner, sum string
+}
+
+// parseBeginMarker parses a BEGIN marker line.
+func parseBeginMarker(line string) (marker, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), beginMarker)
+	fields := strings.Fields(rest)
+	if !ok || len(fields) == 0 {
+		return marker{}, false
+	}
+	m := marker{alias: fields[0]}
+	for _, f := range fields[1:] {
+		if v, ok := strings.CutPrefix(f, ownerPrefix); ok {
+			m.owner = v
+		} else if v, ok := strings.CutPrefix(f, sumPrefix); ok {
+			m.sum = v
+		}
+	}
+	return m, true
+}
+
+// String returns the BEGIN marker line.
+func (m marker) String() string {
+	line := beginMarker + m.alias
+	if m.owner != "" {
+		line += " " + ownerPrefix + m.owner
+	}
+	if m.sum != "" {
+		line += " " + sumPrefix + m.sum
+	}
+	return line
+}
+
+// bodySum returns the checksum of the lines of a block between its markers. Line endings
+// are normalized, so a file converted to CRLF doesn't look edited.
+func bodySum(body []string) string {
+	h := sha256.New()
+	for _, l := range body {
+		h.Write([]byte(strings.TrimSuffix(l, "\r")))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:4])
+}
+
+// ConflictError reports an unmanaged Host block that already defines an alias gipo wants to manage.
+type ConflictError struct {
+	Alias string
+	// Path and Line locate the Host line of the conflicting block, which may be in an included file.
+	Path string
+	Line int
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s:%d: unmanaged Host block already defines alias %s", e.Path, e.Line, e.Alias)
+}
+
 // Entry describes an ssh config host entry managed by gitprofiles
 type Entry struct {
-	Alias        string
-	HostName     string
-	User         string
-	IdentityFile string
+	Alias        string `json:"alias"`
+	HostName     string `json:"hostname"`
+	User         string `json:"user"`
+	IdentityFile string `json:"identity_file"`
+	// ExtraIdentityFiles are offered after IdentityFile, e.g. a rotated key still in its grace period.
+	ExtraIdentityFiles []string `json:"extra_identity_files,omitempty"`
+	// Options are further directives written after the identity files, in order.
+	// "IdentitiesOnly yes" is added unless Options sets IdentitiesOnly itself.
+	Options []Option `json:"options,omitempty"`
+	// Owner identifies the profile store that manages the block; empty for blocks written
+	// before blocks had owners.
+	Owner string `json:"owner,omitempty"`
+}
+
+// Option is a single ssh config directive such as "Port 2222".
+type Option struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// reservedKeys are directives written from Entry's own fields; they can't be Options.
+var reservedKeys = []string{"host", "match", "include", "hostname", "user", "identityfile"}
+
+// ParseOption parses "Key=Value" or "Key Value" into an Option.
+func ParseOption(s string) (Option, error) {
+	kw, rest := splitKeyword(strings.TrimSpace(s))
+	if kw == "" || rest == "" {
+		return Option{}, fmt.Errorf("invalid ssh option %q: expected Key=Value", s)
+	}
+	// a newline would start a directive of its own inside the managed block
+	if strings.ContainsFunc(kw+rest, func(r rune) bool { return unicode.IsControl(r) && r != '\t' }) {
+		return Option{}, fmt.Errorf("invalid ssh option %q: control characters are not allowed", s)
+	}
+	if slices.Contains(reservedKeys, strings.ToLower(kw)) {
+		return Option{}, fmt.Errorf("ssh option %s is managed by gipo and can't be set", kw)
+	}
+	if _, err := splitArgs(rest); err != nil {
+		return Option{}, fmt.Errorf("invalid ssh option %q: %w", s, err)
+	}
+	return Option{Key: kw, Value: rest}, nil
+}
+
+// effectiveOptions returns the options written for e, including the IdentitiesOnly default.
+func (e Entry) effectiveOptions() []Option {
+	for _, o := range e.Options {
+		if strings.EqualFold(o.Key, "IdentitiesOnly") {
+			return e.Options
+		}
+	}
+	return append(slices.Clone(e.Options), Option{Key: "IdentitiesOnly", Value: "yes"})
+}
+
+// Equal reports whether e and o produce the same managed block. Option keys are compared
+// case-insensitively, like ssh does.
+func (e Entry) Equal(o Entry) bool {
+	if e.Alias != o.Alias || e.Owner != o.Owner || e.HostName != o.HostName || e.User != o.User || e.IdentityFile != o.IdentityFile ||
+		!slices.Equal(e.ExtraIdentityFiles, o.ExtraIdentityFiles) {
+		return false
+	}
+	return slices.EqualFunc(e.effectiveOptions(), o.effectiveOptions(), func(a, b Option) bool {
+		return strings.EqualFold(a.Key, b.Key) && a.Value == b.Value
+	})
 }
 
 // toRelPath converts an absolute path to a path relative to home, prefixed with ~, if inside home.
@@ -45,8 +177,58 @@ func toAbsPath(path string) string {
 	return path
 }
 
+// FieldChange is a directive whose value differs between two entries. Before or After
+// is empty when the directive only exists on one side; repeated directives are joined by ", ".
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// Changes lists the directives that differ from e to o, in block order.
+func (e Entry) Changes(o Entry) []FieldChange {
+	var out []FieldChange
+	add := func(field, before, after string) {
+		if before != after {
+			out = append(out, FieldChange{Field: field, Before: before, After: after})
+		}
+	}
+	add("Owner", e.Owner, o.Owner)
+	add("HostName", e.HostName, o.HostName)
+	add("User", e.User, o.User)
+	add("IdentityFile",
+		strings.Join(slices.Concat([]string{e.IdentityFile}, e.ExtraIdentityFiles), ", "),
+		strings.Join(slices.Concat([]string{o.IdentityFile}, o.ExtraIdentityFiles), ", "))
+
+	before, after := e.effectiveOptions(), o.effectiveOptions()
+	var keys []string
+	names := make(map[string]string)
+	for _, opt := range slices.Concat(before, after) {
+		k := strings.ToLower(opt.Key)
+		if _, ok := names[k]; !ok {
+			keys = append(keys, k)
+			names[k] = opt.Key
+		}
+	}
+	values := func(opts []Option, k string) string {
+		var vs []string
+		for _, opt := range opts {
+			if strings.EqualFold(opt.Key, k) {
+				vs = append(vs, opt.Value)
+			}
+		}
+		return strings.Join(vs, ", ")
+	}
+	for _, k := range keys {
+		add(names[k], values(before, k), values(after, k))
+	}
+	return out
+}
+
 // AddOrReplaceEntry adds or replaces a managed block for alias in configPath.
-// If the file doesn't exist it is created.
+// If the file doesn't exist it is created. The file is locked while it is updated and
+// replaced atomically, keeping its mode and symlinks. Files with damaged managed blocks
+// are left alone and a *DamagedError is returned.
 func AddOrReplaceEntry(configPath string, e Entry) error {
 	if configPath == "" {
 		home, err := os.UserHomeDir()
@@ -56,50 +238,125 @@ func AddOrReplaceEntry(configPath string, e Entry) error {
 		configPath = filepath.Join(home, ".ssh", "config")
 	}
 
+	lock, err := fsutil.Acquire(configPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	b, err := os.ReadFile(configPath)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	content := string(b)
 
-	begin := fmt.Sprintf("# BEGIN GITPROFILES %s", e.Alias)
-	end := fmt.Sprintf("# END GITPROFILES %s", e.Alias)
+	cfg, err := parse(strings.NewReader(content), configPath, filepath.Dir(configPath), 0)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Conflict(e.Alias); err != nil {
+		return err
+	}
+	if err := checkDamage(configPath, content); err != nil {
+		return err
+	}
+
+	return fsutil.WriteFile(configPath, []byte(SetEntry(content, e)), 0o600)
+}
+
+// RenderEntry returns the managed block for e, markers included.
+func RenderEntry(e Entry) string {
+	body := renderBody(e)
+	m := marker{alias: e.Alias, owner: e.Owner, sum: bodySum(body)}
+	return m.String() + "\n" + strings.Join(body, "\n") + "\n" + endMarker + e.Alias + "\n"
+}
+
+// renderBody returns the lines of the managed block for e between its markers.
+func renderBody(e Entry) []string {
 	blockLines := []string{
-		begin,
 		fmt.Sprintf("Host %s", e.Alias),
 		fmt.Sprintf("    HostName %s", e.HostName),
 		fmt.Sprintf("    User %s", e.User),
 		fmt.Sprintf("    IdentityFile \"%s\"", toRelPath(e.IdentityFile)),
-		"    IdentitiesOnly yes",
-		end,
 	}
-	block := strings.Join(blockLines, "\n") + "\n"
+	for _, f := range e.ExtraIdentityFiles {
+		blockLines = append(blockLines, fmt.Sprintf("    IdentityFile \"%s\"", toRelPath(f)))
+	}
+	for _, o := range e.effectiveOptions() {
+		blockLines = append(blockLines, fmt.Sprintf("    %s %s", o.Key, o.Value))
+	}
+	return blockLines
+}
 
-	if idx := strings.Index(content, begin); idx != -1 {
+// SetEntry returns content with the managed block for e.Alias replaced by a fresh one,
+// or with the block appended if there is none.
+func SetEntry(content string, e Entry) string {
+	end := endMarker + e.Alias
+	block := RenderEntry(e)
+
+	if idx := beginIndex(content, e.Alias); idx != -1 {
 		// replace existing block
-		endIdx := strings.Index(content[idx:], end)
+		endIdx := markerIndex(content, end, idx)
 		if endIdx == -1 {
-			// malformed, append block
-			content = content + "\n" + block
-		} else {
-			endIdx = idx + endIdx + len(end)
-			// include following newline if present
-			if endIdx < len(content) && content[endIdx] == '\n' {
-				endIdx++
-			}
-			content = content[:idx] + block + content[endIdx:]
+			// malformed, append block; the exported writers refuse such files (see Repair)
+			return content + "\n" + block
 		}
-	} else {
-		if !strings.HasSuffix(content, "\n") && len(content) > 0 {
-			content = content + "\n"
+		endIdx = lineEnd(content, endIdx+len(end))
+		// include following newline if present
+		if endIdx < len(content) && content[endIdx] == '\n' {
+			endIdx++
 		}
-		content = content + block
+		return content[:idx] + block + content[endIdx:]
 	}
+	if !strings.HasSuffix(content, "\n") && len(content) > 0 {
+		content = content + "\n"
+	}
+	return content + block
+}
+
+// ManagedBlock returns the text of the managed block for alias in content, markers included.
+func ManagedBlock(content, alias string) (string, bool) {
+	idx := beginIndex(content, alias)
+	if idx == -1 {
+		return "", false
+	}
+	end := endMarker + alias
+	endIdx := markerIndex(content, end, idx)
+	if endIdx == -1 {
+		return "", false
+	}
+	endIdx = lineEnd(content, endIdx+len(end))
+	if endIdx < len(content) && content[endIdx] == '\n' {
+		endIdx++
+	}
+	return content[idx:endIdx], true
+}
+
+// HandModified reports whether a managed block, as returned by ManagedBlock, was edited
+// since gipo wrote it. Blocks written before blocks had checksums are compared with a fresh
+// rendering of their own entry, which can't tell an added option from one gipo wrote.
+func HandModified(block string) bool {
+	lines := strings.Split(strings.TrimSuffix(block, "\n"), "\n")
+	m, ok := parseBeginMarker(lines[0])
+	if !ok || len(lines) < 2 {
+		return false
+	}
+	body := lines[1 : len(lines)-1]
+	if m.sum != "" {
+		return bodySum(body) != m.sum
+	}
+	entries := Entries(block)
+	return len(entries) != 1 || bodySum(body) != bodySum(renderBody(entries[0]))
+}
 
-	return os.WriteFile(configPath, []byte(content), 0o600)
+// HasChecksum reports whether the BEGIN marker of block carries a checksum.
+func HasChecksum(block string) bool {
+	m, ok := parseBeginMarker(strings.SplitN(block, "\n", 2)[0])
+	return ok && m.sum != ""
 }
 
 // RemoveEntry removes a managed block for alias from configPath. No-op if not found.
+// Like AddOrReplaceEntry it refuses to edit damaged files.
 func RemoveEntry(configPath, alias string) error {
 	if configPath == "" {
 		home, err := os.UserHomeDir()
@@ -109,32 +366,92 @@ func RemoveEntry(configPath, alias string) error {
 		configPath = filepath.Join(home, ".ssh", "config")
 	}
 
+	lock, err := fsutil.Acquire(configPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	b, err := os.ReadFile(configPath)
 	if err != nil {
 		return err
 	}
 	content := string(b)
+	if err := checkDamage(configPath, content); err != nil {
+		return err
+	}
 
-	begin := fmt.Sprintf("# BEGIN GITPROFILES %s", alias)
-	end := fmt.Sprintf("# END GITPROFILES %s", alias)
-	if idx := strings.Index(content, begin); idx != -1 {
-		endIdx := strings.Index(content[idx:], end)
-		if endIdx == -1 {
-			// malformed, return error to avoid accidental deletion
-			return fmt.Errorf("malformed config: found BEGIN marker for %s but no END marker", alias)
-		} else {
-			endIdx = idx + endIdx + len(end)
-			if endIdx < len(content) && content[endIdx] == '\n' {
-				endIdx++
-			}
-			content = content[:idx] + content[endIdx:]
+	updated, err := DeleteEntry(content, alias)
+	if err != nil || updated == content {
+		return err
+	}
+	return fsutil.WriteFile(configPath, []byte(updated), 0o600)
+}
+
+// DeleteEntry returns content without the managed block for alias. It is an error if the
+// block has no END marker, to avoid deleting the rest of the file.
+func DeleteEntry(content, alias string) (string, error) {
+	end := endMarker + alias
+	idx := beginIndex(content, alias)
+	if idx == -1 {
+		return content, nil
+	}
+	endIdx := markerIndex(content, end, idx)
+	if endIdx == -1 {
+		// malformed, return error to avoid accidental deletion
+		return content, fmt.Errorf("malformed config: found BEGIN marker for %s but no END marker", alias)
+	}
+	endIdx = lineEnd(content, endIdx+len(end))
+	if endIdx < len(content) && content[endIdx] == '\n' {
+		endIdx++
+	}
+	return content[:idx] + content[endIdx:], nil
+}
+
+// lineEnd skips trailing blanks after a marker, up to the newline.
+func lineEnd(content string, i int) int {
+	for i < len(content) && (content[i] == ' ' || content[i] == '\t' || content[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// markerIndex returns the offset of the first line at or after from that is exactly
+// marker, ignoring surrounding whitespace, or -1.
+func markerIndex(content, marker string, from int) int {
+	return lineIndex(content, from, func(line string) bool { return strings.TrimSpace(line) == marker })
+}
+
+// beginIndex returns the offset of the BEGIN marker for alias, whatever its owner, or -1.
+func beginIndex(content, alias string) int {
+	return lineIndex(content, 0, func(line string) bool {
+		m, ok := parseBeginMarker(line)
+		return ok && m.alias == alias
+	})
+}
+
+// lineIndex returns the offset of the first line at or after from matching match, after
+// its leading whitespace, or -1.
+func lineIndex(content string, from int, match func(string) bool) int {
+	for i := from; i < len(content); {
+		j := strings.IndexByte(content[i:], '\n')
+		line := content[i:]
+		if j != -1 {
+			line = content[i : i+j]
 		}
-		return os.WriteFile(configPath, []byte(content), 0o600)
+		if match(line) {
+			return i + len(line) - len(strings.TrimLeft(line, " \t"))
+		}
+		if j == -1 {
+			break
+		}
+		i += j + 1
 	}
-	return nil
+	return -1
 }
 
-// ListEntries parses the config file and returns managed entries
+// ListEntries parses the config file and returns managed entries. It returns a
+// *DamagedError if the managed blocks need a repair first.
 func ListEntries(configPath string) ([]Entry, error) {
 	if configPath == "" {
 		home, err := os.UserHomeDir()
@@ -148,33 +465,123 @@ func ListEntries(configPath string) ([]Entry, error) {
 	if err != nil {
 		return nil, err
 	}
-	content := string(b)
+	if err := checkDamage(configPath, string(b)); err != nil {
+		return nil, err
+	}
+	return Entries(string(b)), nil
+}
 
+// Entries returns the managed entries found in the content of an ssh config file.
+// Blocks without an END marker are skipped.
+func Entries(content string) []Entry {
 	var out []Entry
 	lines := strings.Split(content, "\n")
 	for i := 0; i < len(lines); i++ {
-		line := strings.TrimSpace(lines[i])
-		if strings.HasPrefix(line, "# BEGIN GITPROFILES ") {
-			alias := strings.TrimPrefix(line, "# BEGIN GITPROFILES ")
-			var e Entry
-			e.Alias = alias
+		if m, ok := parseBeginMarker(lines[i]); ok {
+			e := Entry{Alias: m.alias, Owner: m.owner}
 			// parse following lines until END marker
 			for j := i + 1; j < len(lines); j++ {
 				l := strings.TrimSpace(lines[j])
-				if strings.HasPrefix(l, "HostName ") {
-					e.HostName = strings.TrimSpace(strings.TrimPrefix(l, "HostName "))
-				} else if strings.HasPrefix(l, "User ") {
-					e.User = strings.TrimSpace(strings.TrimPrefix(l, "User "))
-				} else if strings.HasPrefix(l, "IdentityFile ") {
-					e.IdentityFile = strings.Trim(strings.TrimSpace(strings.TrimPrefix(l, "IdentityFile ")), "\"")
-					e.IdentityFile = toAbsPath(e.IdentityFile)
-				} else if strings.HasPrefix(l, "# END GITPROFILES ") {
+				if strings.HasPrefix(l, endMarker) {
 					out = append(out, e)
 					i = j
 					break
 				}
+				if l == "" || strings.HasPrefix(l, "#") {
+					continue
+				}
+				kw, rest := splitKeyword(l)
+				switch strings.ToLower(kw) {
+				case "host":
+				case "hostname":
+					e.HostName = rest
+				case "user":
+					e.User = rest
+				case "identityfile":
+					f := toAbsPath(strings.Trim(rest, "\""))
+					if e.IdentityFile == "" {
+						e.IdentityFile = f
+					} else {
+						e.ExtraIdentityFiles = append(e.ExtraIdentityFiles, f)
+					}
+				default:
+					e.Options = append(e.Options, Option{Key: kw, Value: rest})
+				}
 			}
 		}
 	}
-	return out, nil
+	return out
+}
+
+// EnsureInclude makes sure configPath has an Include directive for includePath in its global
+// section. A missing directive is added as the first line, and any other Include of the same
+// file (e.g. inside a Host block, where it would only apply conditionally) is removed.
+// It reports whether the file was changed. The file is created if it doesn't exist.
+func EnsureInclude(configPath, includePath string) (bool, error) {
+	lock, err := fsutil.Acquire(configPath)
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+
+	b, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	content, changed, err := SetInclude(string(b), configPath, includePath)
+	if err != nil || !changed {
+		return false, err
+	}
+	if err := fsutil.WriteFile(configPath, []byte(content), 0o600); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetInclude is EnsureInclude on the content of configPath. It returns the new content
+// and whether it differs.
+func SetInclude(content, configPath, includePath string) (string, bool, error) {
+	cfg, err := Parse(strings.NewReader(content))
+	if err != nil {
+		return content, false, err
+	}
+	cfg.Path = configPath
+
+	var refs []*Line
+	for _, l := range cfg.Lines {
+		if l.Is("Include") && slices.ContainsFunc(l.Args, func(a string) bool { return cfg.includeRefers(a, includePath) }) {
+			refs = append(refs, l)
+		}
+	}
+	if len(refs) == 1 && cfg.Includes(includePath) {
+		return content, false, nil
+	}
+
+	lines := []string{"Include " + quoteArg(toRelPath(includePath))}
+	for _, l := range cfg.Lines {
+		if !slices.Contains(refs, l) {
+			lines = append(lines, l.Raw)
+			continue
+		}
+		// keep the other files named on the same line
+		var rest []string
+		for _, a := range l.Args {
+			if !cfg.includeRefers(a, includePath) {
+				rest = append(rest, quoteArg(a))
+			}
+		}
+		if len(rest) > 0 {
+			indent := l.Raw[:len(l.Raw)-len(strings.TrimLeft(l.Raw, " \t"))]
+			lines = append(lines, indent+l.Keyword+" "+strings.Join(rest, " "))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n", true, nil
+}
+
+// quoteArg quotes an ssh config argument containing whitespace.
+func quoteArg(a string) string {
+	if strings.ContainsAny(a, " \t") {
+		return "\"" + a + "\""
+	}
+	return a
 }
@@ -3,6 +3,8 @@ package sshconfig
 import (
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -51,6 +53,19 @@ func TestAddReplaceRemove(t *testing.T) {
 		t.Fatalf("list entries mismatch: %#v", list)
 	}
 
+	// Extra identity files round trip in order
+	entry.ExtraIdentityFiles = []string{"/home/user/.ssh/git_profiles/keys/acct1.old"}
+	if err := AddOrReplaceEntry(cfg, entry); err != nil {
+		t.Fatal(err)
+	}
+	list, err = ListEntries(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].IdentityFile != entry.IdentityFile || len(list[0].ExtraIdentityFiles) != 1 || list[0].ExtraIdentityFiles[0] != entry.ExtraIdentityFiles[0] {
+		t.Fatalf("identity files mismatch: %#v", list)
+	}
+
 	// Remove
 	if err := RemoveEntry(cfg, entry.Alias); err != nil {
 		t.Fatal(err)
@@ -76,3 +91,137 @@ func indexOf(s, sub string) int {
 	}
 	return -1
 }
+
+func TestEntryOptions(t *testing.T) {
+	d := t.TempDir()
+	cfg := filepath.Join(d, "config")
+
+	entry := Entry{
+		Alias:        "git-work-gitlab",
+		HostName:     "gitlab.example.com",
+		User:         "git",
+		IdentityFile: "/keys/work",
+		Options: []Option{
+			{Key: "Port", Value: "2222"},
+			{Key: "ProxyJump", Value: "bastion1,bastion2"},
+			{Key: "SetEnv", Value: `FOO="a b"`},
+		},
+	}
+	if err := AddOrReplaceEntry(cfg, entry); err != nil {
+		t.Fatal(err)
+	}
+	list, err := ListEntries(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !list[0].Equal(entry) {
+		t.Fatalf("options did not round trip: %#v", list)
+	}
+	if n := len(list[0].Options); n != 4 || list[0].Options[3].Key != "IdentitiesOnly" {
+		t.Fatalf("expected options followed by the IdentitiesOnly default, got %#v", list[0].Options)
+	}
+
+	changed := entry
+	changed.Options = []Option{{Key: "Port", Value: "22"}}
+	if list[0].Equal(changed) {
+		t.Fatal("expected a changed option to be detected")
+	}
+	// an explicit IdentitiesOnly replaces the default
+	changed.Options = []Option{{Key: "IdentitiesOnly", Value: "no"}}
+	if err := AddOrReplaceEntry(cfg, changed); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(cfg)
+	if stringsContains(string(b), "IdentitiesOnly yes") {
+		t.Fatalf("expected default IdentitiesOnly to be dropped:\n%s", b)
+	}
+}
+
+func TestParseOption(t *testing.T) {
+	for in, want := range map[string]Option{
+		"Port=2222":                  {Key: "Port", Value: "2222"},
+		"ProxyJump a,b":              {Key: "ProxyJump", Value: "a,b"},
+		" ServerAliveInterval = 30 ": {Key: "ServerAliveInterval", Value: "30"},
+	} {
+		got, err := ParseOption(in)
+		if err != nil || got != want {
+			t.Errorf("ParseOption(%q) = %#v, %v; want %#v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"Port", "HostName=x", "identityfile=~/.ssh/k", `SetEnv "x`, "Port 22\nHost *", "Port=22\r\nUser root", "Por\x00t 22"} {
+		if _, err := ParseOption(in); err == nil {
+			t.Errorf("ParseOption(%q): expected error", in)
+		}
+	}
+}
+
+func TestEntryChanges(t *testing.T) {
+	before := Entry{Alias: "a", HostName: "h", IdentityFile: "/k", Options: []Option{{Key: "Port", Value: "22"}}}
+	after := Entry{Alias: "a", HostName: "h", User: "git", IdentityFile: "/k", Options: []Option{{Key: "ProxyJump", Value: "b"}}}
+	got := before.Changes(after)
+	want := []FieldChange{
+		{Field: "User", Before: "", After: "git"},
+		{Field: "Port", Before: "22", After: ""},
+		{Field: "ProxyJump", Before: "", After: "b"},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Changes = %#v, want %#v", got, want)
+	}
+	if c := before.Changes(before); len(c) != 0 {
+		t.Fatalf("expected no changes, got %#v", c)
+	}
+}
+
+func TestEntryOwner(t *testing.T) {
+	e := Entry{Alias: "git-a", HostName: "h", IdentityFile: "/k", Owner: "1234abcd"}
+	content := RenderEntry(e)
+	if !strings.HasPrefix(content, "# BEGIN GITPROFILES git-a owner=1234abcd sum=") {
+		t.Fatalf("expected owner in marker:\n%s", content)
+	}
+	got := Entries(content)
+	if len(got) != 1 || !got[0].Equal(e) {
+		t.Fatalf("owner did not round trip: %#v", got)
+	}
+	// a block of another owner is still found by alias
+	e.Owner = "ffff0000"
+	updated := SetEntry(content, e)
+	if got := Entries(updated); len(got) != 1 || got[0].Owner != "ffff0000" {
+		t.Fatalf("expected block replaced, got:\n%s", updated)
+	}
+	if updated, err := DeleteEntry(updated, "git-a"); err != nil || updated != "" {
+		t.Fatalf("expected block deleted, got %q (%v)", updated, err)
+	}
+}
+
+func TestHandModified(t *testing.T) {
+	e := Entry{Alias: "git-a", HostName: "h", User: "git", IdentityFile: "/k"}
+	content := "Host other\n\n" + RenderEntry(e)
+	block, ok := ManagedBlock(content, "git-a")
+	if !ok || block != RenderEntry(e) {
+		t.Fatalf("ManagedBlock = %q, %v", block, ok)
+	}
+	if HandModified(block) || !HasChecksum(block) {
+		t.Fatal("expected a fresh block to be unmodified and checksummed")
+	}
+	for _, edit := range []string{
+		strings.Replace(block, "    IdentitiesOnly yes\n", "", 1),
+		strings.Replace(block, "    User git\n", "    User git\n    Port 22\n", 1),
+		strings.Replace(block, "Host git-a\n", "Host git-a\n# note\n", 1),
+	} {
+		if !HandModified(edit) {
+			t.Errorf("expected edit to be detected:\n%s", edit)
+		}
+	}
+	if HandModified(strings.ReplaceAll(block, "\n", "\r\n")) {
+		t.Error("line endings alone are not an edit")
+	}
+
+	// blocks without a checksum are compared with their own rendering
+	legacy := "# BEGIN GITPROFILES git-a\n" + strings.SplitN(block, "\n", 2)[1]
+	if HandModified(legacy) || HasChecksum(legacy) {
+		t.Fatal("expected legacy block to be unmodified and without checksum")
+	}
+	if !HandModified(strings.Replace(legacy, "    IdentitiesOnly yes\n", "", 1)) {
+		t.Fatal("expected deleted default option in legacy block to be detected")
+	}
+}
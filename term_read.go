@@ -1,13 +1,96 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"golang.org/x/term"
 )
 
+// stdin is shared by all prompts so buffered input isn't lost between questions.
+var stdin = bufio.NewReader(os.Stdin)
+
 func readPassword() ([]byte, error) {
 	b, err := term.ReadPassword(int(os.Stdin.Fd()))
 	// term.ReadPassword doesn't print newline; mimic user pressing enter
 	return b, err
 }
+
+// readNewPassphrase reads a passphrase for a new key. With fd >= 0 the first line read from
+// that file descriptor is used; otherwise the passphrase is prompted for twice on the terminal.
+func readNewPassphrase(fd int) ([]byte, error) {
+	if fd >= 0 {
+		f := os.NewFile(uintptr(fd), "passphrase-fd")
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		defer f.Close()
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+		p := []byte(strings.TrimRight(line, "\r\n"))
+		if len(p) == 0 {
+			return nil, errors.New("empty passphrase")
+		}
+		return p, nil
+	}
+
+	fmt.Fprint(os.Stderr, "New key passphrase: ")
+	p, err := readPassword()
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	again, err := readPassword()
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if string(p) != string(again) {
+		return nil, errors.New("passphrases do not match")
+	}
+	return p, nil
+}
+
+// confirm asks a yes/no question on stderr and reads the answer from stdin.
+// Anything other than "y" or "yes" is treated as no.
+func confirm(question string) (bool, error) {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// choose lists options on stderr and reads the number of one from stdin. An empty or
+// invalid answer is an error.
+func choose(question string, options []string) (string, error) {
+	fmt.Fprintln(os.Stderr, question)
+	for i, o := range options {
+		fmt.Fprintf(os.Stderr, "  %d) %s\n", i+1, o)
+	}
+	fmt.Fprintf(os.Stderr, "Choice [1-%d]: ", len(options))
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || n < 1 || n > len(options) {
+		return "", fmt.Errorf("invalid choice %q", strings.TrimSpace(line))
+	}
+	return options[n-1], nil
+}